@@ -0,0 +1,96 @@
+package api
+
+import (
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// AggregateEntities groups the entities matching the filters of the query
+// string and returns metrics per group, e.g.
+// GET /api/post/_aggregate?groupBy=status&metrics=count(*),max(create_time)&having=count(*)>1
+func (api *EntityRestAPI) AggregateEntities(w rest.ResponseWriter, r *rest.Request) {
+	entity := r.PathParam("entity")
+	if !api.checkOperation(w, entity, List) {
+		return
+	}
+
+	aggregator, ok := api.em.(eram.Aggregator)
+	if !ok {
+		writeProblem(w, notImplemented("aggregations"))
+		return
+	}
+
+	qs := r.Request.URL.Query()
+
+	aggregation := eram.Aggregation{
+		GroupBy:   splitList(qs.Get("groupBy")),
+		Metrics:   splitList(qs.Get("metrics")),
+		Having:    splitList(qs.Get("having")),
+		SortField: qs.Get("_sortField"),
+		SortDir:   qs.Get("_sortDir"),
+	}
+
+	if aggregation.SortField == "" {
+		aggregation.SortField = qs.Get("_sort")
+	}
+
+	// groups are not paginated, and the parameters of lists are no filters
+	for _, param := range []string{"groupBy", "metrics", "having", "_sortField", "_sort", "_sortDir", "_perPage", "_page"} {
+		qs.Del(param)
+	}
+
+	readOptions := readOptions(qs)
+
+	filterParams := make(map[string]string)
+	for filterName := range qs {
+		filterParams[filterName] = qs.Get(filterName)
+	}
+
+	groups, err := aggregator.AggregateEntities(entity, filterParams, aggregation, readOptions...)
+	if err != nil {
+		api.writeError(w, entity, err)
+		return
+	}
+
+	w.WriteJson(groups)
+}
+
+// FacetEntities returns the distinct values of fields with their counts among
+// the entities matching the filters of the query string, e.g.
+// GET /api/post/_facets?fields=status,author_id
+func (api *EntityRestAPI) FacetEntities(w rest.ResponseWriter, r *rest.Request) {
+	entity := r.PathParam("entity")
+	if !api.checkOperation(w, entity, List) {
+		return
+	}
+
+	aggregator, ok := api.em.(eram.Aggregator)
+	if !ok {
+		writeProblem(w, notImplemented("facets"))
+		return
+	}
+
+	qs := r.Request.URL.Query()
+
+	fields := splitList(qs.Get("fields"))
+
+	// facets count every matching entity, whatever the page or sort of the list
+	for _, param := range []string{"fields", "_sortField", "_sort", "_sortDir", "_perPage", "_page"} {
+		qs.Del(param)
+	}
+
+	readOptions := readOptions(qs)
+
+	filterParams := make(map[string]string)
+	for filterName := range qs {
+		filterParams[filterName] = qs.Get(filterName)
+	}
+
+	facets, err := aggregator.FacetEntities(entity, filterParams, fields, readOptions...)
+	if err != nil {
+		api.writeError(w, entity, err)
+		return
+	}
+
+	w.WriteJson(facets)
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// batchReference matches values such as "$1.id", which point to the field of
+// the entity returned by an earlier operation of the same batch (1-based).
+var batchReference = regexp.MustCompile(`^\$(\d+)\.(\w+)$`)
+
+// integerId matches the ids given as strings.
+var integerId = regexp.MustCompile(`^\d+$`)
+
+var errBatchFailed = errors.New("batch operation failed")
+
+// BatchOperation is a single step of a batch request.
+type BatchOperation struct {
+	Method string                 `json:"method"`
+	Entity string                 `json:"entity"`
+	Id     interface{}            `json:"id,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// BatchResult is the outcome of a single step of a batch request.
+type BatchResult struct {
+	Status int                    `json:"status"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// PostBatch runs an ordered list of operations inside one transaction. The
+// first failing operation rolls the whole batch back; the response lists the
+// result of every operation that was attempted.
+func (api *EntityRestAPI) PostBatch(w rest.ResponseWriter, r *rest.Request) {
+	operations := []BatchOperation{}
+	if err := r.DecodeJsonPayload(&operations); err != nil {
+		writeProblem(w, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	results := make([]BatchResult, 0, len(operations))
+	status := http.StatusOK
+
+	err := api.em.InTransaction(func(txm eram.EntityManager) error {
+		for _, op := range operations {
+			result := api.runBatchOperation(txm, op, results)
+			results = append(results, result)
+
+			if result.Error != "" {
+				status = result.Status
+				return errBatchFailed
+			}
+		}
+		return nil
+	})
+
+	if err != nil && err != errBatchFailed {
+		api.writeError(w, "", err)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.WriteJson(results)
+}
+
+func (api *EntityRestAPI) runBatchOperation(txm eram.EntityManager, op BatchOperation, previous []BatchResult) BatchResult {
+	if op.Entity == "" {
+		return BatchResult{Status: http.StatusBadRequest, Error: "Missing entity"}
+	}
+
+	id, err := resolveBatchValue(op.Id, previous)
+	if err != nil {
+		return BatchResult{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	data := make(map[string]interface{}, len(op.Data))
+	for key, value := range op.Data {
+		if data[key], err = resolveBatchValue(value, previous); err != nil {
+			return BatchResult{Status: http.StatusBadRequest, Error: err.Error()}
+		}
+	}
+
+	entityId, ok := batchId(id)
+	if !ok {
+		return BatchResult{Status: http.StatusBadRequest, Error: "Id must be an integer"}
+	} else if entityId == "" && (op.Method == BatchUpdate || op.Method == BatchDelete) {
+		return BatchResult{Status: http.StatusBadRequest, Error: "Missing id"}
+	}
+
+	// a batch cannot bypass the operations an entity allows
+	switch op.Method {
+	case BatchCreate, BatchUpdate, BatchDelete:
+		if !api.allows(txm, op.Entity, Bulk) || !api.allows(txm, op.Entity, Operation(op.Method)) {
+			return BatchResult{Status: http.StatusMethodNotAllowed, Error: fmt.Sprintf("Entity '%s' does not allow the %s operation in a batch.", op.Entity, op.Method)}
+		}
+	}
+
+	switch op.Method {
+	case BatchCreate:
+		newId, err := txm.PostEntity(op.Entity, data)
+		if err != nil {
+			return api.batchError(op.Entity, err)
+		}
+
+		inserted, err := txm.GetEntity(op.Entity, strconv.FormatInt(newId, 10))
+		if err != nil {
+			return api.batchError(op.Entity, err)
+		}
+
+		return BatchResult{Status: http.StatusCreated, Data: inserted}
+	case BatchUpdate:
+		_, updated, err := txm.UpdateEntityIfMatch(op.Entity, entityId, data, "")
+		if err != nil {
+			return api.batchError(op.Entity, err)
+		} else if len(updated) <= 0 {
+			return BatchResult{Status: http.StatusNotFound, Error: notFound(op.Entity, entityId).Detail}
+		}
+
+		return BatchResult{Status: http.StatusOK, Data: updated}
+	case BatchDelete:
+		rowsAffected, err := txm.DeleteEntityIfMatch(op.Entity, entityId, "")
+		if err != nil {
+			return api.batchError(op.Entity, err)
+		} else if rowsAffected == 0 {
+			return BatchResult{Status: http.StatusNotFound, Error: notFound(op.Entity, entityId).Detail}
+		}
+
+		return BatchResult{Status: http.StatusOK}
+	}
+
+	return BatchResult{Status: http.StatusBadRequest, Error: fmt.Sprintf("Unknown method '%s'", op.Method)}
+}
+
+// batchError turns an error returned by the manager into a failed result.
+func (api *EntityRestAPI) batchError(entity string, err error) BatchResult {
+	p := api.problemFor(entity, err)
+
+	message := p.Detail
+	if message == "" {
+		message = p.Title
+	}
+
+	return BatchResult{Status: p.Status, Error: message}
+}
+
+// resolveBatchValue replaces a reference such as "$1.id" with the matching
+// field of a previous result. Any other value is returned unchanged.
+func resolveBatchValue(value interface{}, previous []BatchResult) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+
+	match := batchReference.FindStringSubmatch(s)
+	if match == nil {
+		return value, nil
+	}
+
+	n, _ := strconv.Atoi(match[1])
+	if n < 1 || n > len(previous) {
+		return nil, fmt.Errorf("Reference '%s' points to an unknown operation", s)
+	}
+
+	resolved, ok := previous[n-1].Data[match[2]]
+	if !ok {
+		return nil, fmt.Errorf("Reference '%s' points to an unknown field", s)
+	}
+
+	return resolved, nil
+}
+
+// batchId formats an operation id, which must be an integer: a JSON number,
+// decoded as float64, a string of digits, or an id resolved from a previous
+// result. Any other value is rejected, since the id ends up in SQL.
+func batchId(id interface{}) (string, bool) {
+	switch t := id.(type) {
+	case nil:
+		return "", true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), t == math.Trunc(t)
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case int:
+		return strconv.Itoa(t), true
+	case string:
+		return t, integerId.MatchString(t)
+	}
+	return "", false
+}
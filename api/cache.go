@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+const (
+	CacheControlHeader    = "Cache-Control"
+	LastModifiedHeader    = "Last-Modified"
+	IfNoneMatchHeader     = "If-None-Match"
+	IfModifiedSinceHeader = "If-Modified-Since"
+)
+
+// SetCacheControl sets the Cache-Control header sent with every read of
+// entity, e.g. "max-age=60" or "no-cache".
+func (api *EntityRestAPI) SetCacheControl(entity string, policy string) {
+	api.cacheControl[entity] = policy
+}
+
+// writeCacheHeaders sets the ETag, Last-Modified and Cache-Control headers of
+// a read response. When the conditional headers of the request show that the
+// client already has the representation it also writes a 304 Not Modified
+// response and returns true. Last-Modified is only sent for a single row:
+// deleting a row, or inserting an older one, changes a list without changing
+// the newest time of its rows, so lists rely on their ETag only.
+func (api *EntityRestAPI) writeCacheHeaders(w rest.ResponseWriter, r *rest.Request, entity string, etag string, row map[string]interface{}) bool {
+	w.Header().Add("Access-Control-Expose-Headers", ETagHeader)
+	w.Header().Set(ETagHeader, etag)
+
+	if policy, ok := api.cacheControl[entity]; ok {
+		w.Header().Set(CacheControlHeader, policy)
+	}
+
+	var lastModified time.Time
+	var hasLastModified bool
+	if row != nil {
+		lastModified, hasLastModified = api.em.LastModified(entity, row)
+	}
+
+	if hasLastModified {
+		w.Header().Add("Access-Control-Expose-Headers", LastModifiedHeader)
+		w.Header().Set(LastModifiedHeader, lastModified.Format(http.TimeFormat))
+	}
+
+	notModified := false
+	if ifNoneMatch := r.Header.Get(IfNoneMatchHeader); ifNoneMatch != "" {
+		// If-Modified-Since is ignored when If-None-Match is present
+		notModified = matchWeakEntityTag(ifNoneMatch, etag)
+	} else if ifModifiedSince := r.Header.Get(IfModifiedSinceHeader); ifModifiedSince != "" && hasLastModified {
+		if since, err := http.ParseTime(ifModifiedSince); err == nil {
+			notModified = !lastModified.Truncate(time.Second).After(since)
+		}
+	}
+
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+
+	return notModified
+}
+
+// matchWeakEntityTag reports whether an If-None-Match header value matches
+// etag, using the weak comparison function.
+func matchWeakEntityTag(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
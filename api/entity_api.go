@@ -2,8 +2,12 @@ package api
 
 import (
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 
 	eram "github.com/Onefootball/entity-rest-api/manager"
 	"github.com/ant0ine/go-json-rest/rest"
@@ -16,74 +20,98 @@ const (
 	StatusCodeHeader = "X-Status-Code"
 	EntityIDHeader   = "X-Entity-ID"
 	LocationHeader   = "Location"
+	ETagHeader       = "ETag"
+	IfMatchHeader    = "If-Match"
 )
 
 type EntityRestAPI struct {
-	em *eram.EntityDbManager
+	em           eram.EntityManager
+	cacheControl map[string]string
+	operations   map[string][]Operation
+	logger       *log.Logger
 }
 
-func NewEntityRestAPI(em *eram.EntityDbManager) *EntityRestAPI {
+// NewEntityRestAPI serves the entities of em. The endpoints relying on optional
+// interfaces of the manager, such as eram.Aggregator, answer 501 Not
+// Implemented when em does not implement them.
+func NewEntityRestAPI(em eram.EntityManager) *EntityRestAPI {
 	return &EntityRestAPI{
-		em,
+		em:           em,
+		cacheControl: map[string]string{},
+		operations:   map[string][]Operation{},
+		logger:       log.New(os.Stderr, "[EntityRestAPI] ", log.LstdFlags),
 	}
 }
 
-func (api *EntityRestAPI) GetAllEntities(w rest.ResponseWriter, r *rest.Request) {
-	entity := r.PathParam("entity")
-	qs := r.Request.URL.Query()
-
-	limit, offset, orderBy, orderDir := qs.Get("_perPage"), qs.Get("_page"), qs.Get("_sortField"), qs.Get("_sortDir")
-
-	qs.Del("_perPage")
-	qs.Del("_page")
-	qs.Del("_sortField")
-	qs.Del("_sortDir")
-
-	filterParams := make(map[string]string)
+// SetLogger sets the logger of the errors that cannot be reported to clients,
+// such as unexpected database errors. They are logged to stderr by default.
+func (api *EntityRestAPI) SetLogger(logger *log.Logger) {
+	api.logger = logger
+}
 
-	// remaining GET parameters are used to filter the result
-	for filterName, _ := range qs {
-		filterParams[filterName] = qs.Get(filterName)
+func (api *EntityRestAPI) GetAllEntities(w rest.ResponseWriter, r *rest.Request) {
+	if !api.checkOperation(w, r.PathParam("entity"), List) {
+		return
 	}
 
-	if offset == "" {
-		offset = Offset
-	}
+	api.getEntities(w, r, r.PathParam("entity"))
+}
 
-	if limit == "" {
-		limit = Limit
+// getEntities writes the rows of entity selected by the query string of r,
+// further restricted by opts.
+func (api *EntityRestAPI) getEntities(w rest.ResponseWriter, r *rest.Request, entity string, opts ...eram.ReadOption) {
+	query, err := listQuery(r.Request.URL.Query())
+	if err != nil {
+		api.writeError(w, entity, err)
+		return
 	}
 
-	if orderBy == "" {
-		orderBy = api.em.GetIdColumn(entity)
-	}
+	query.Options = append(query.Options, opts...)
 
-	if orderDir == "" {
-		orderDir = OrderDir
+	if query.SortDir == "" && query.SortField == eram.ScoreField {
+		query.SortDir = "DESC"
+	} else if query.SortDir == "" {
+		query.SortDir = OrderDir
 	}
 
-	allResults, count, dbErr := api.em.GetEntities(entity, filterParams, limit, offset, orderBy, orderDir)
+	allResults, count, dbErr := api.em.ListEntities(entity, query)
 
 	if dbErr != nil {
-		rest.Error(w, dbErr.Error(), http.StatusInternalServerError)
+		api.writeError(w, entity, dbErr)
 		return
 	}
 
 	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
 	w.Header().Set("X-Total-Count", fmt.Sprintf("%d", count))
 
+	etag := eram.HashEntityTag([]interface{}{count, allResults})
+	if api.writeCacheHeaders(w, r, entity, etag, nil) {
+		return
+	}
+
 	w.WriteJson(allResults)
 }
 
 func (api *EntityRestAPI) GetEntity(w rest.ResponseWriter, r *rest.Request) {
-	id := r.PathParam("id")
-	entity := r.PathParam("entity")
-	result, err := api.em.GetEntity(entity, id)
+	if !api.checkOperation(w, r.PathParam("entity"), Read) {
+		return
+	}
+
+	api.getEntity(w, r, r.PathParam("entity"), r.PathParam("id"))
+}
+
+// getEntity writes the entity with the given id, provided it matches opts.
+func (api *EntityRestAPI) getEntity(w rest.ResponseWriter, r *rest.Request, entity string, id string, opts ...eram.ReadOption) {
+	result, err := api.em.GetEntity(entity, id, append(readOptions(r.Request.URL.Query()), opts...)...)
 	if err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		api.writeError(w, entity, err)
 		return
 	} else if len(result) <= 0 {
-		rest.Error(w, "Not Found", http.StatusNotFound)
+		writeProblem(w, notFound(entity, id))
+		return
+	}
+
+	if api.writeCacheHeaders(w, r, entity, api.em.EntityTag(entity, result), result) {
 		return
 	}
 
@@ -91,57 +119,104 @@ func (api *EntityRestAPI) GetEntity(w rest.ResponseWriter, r *rest.Request) {
 }
 
 func (api *EntityRestAPI) PostEntity(w rest.ResponseWriter, r *rest.Request) {
+	if !api.checkOperation(w, r.PathParam("entity"), Create) {
+		return
+	}
+
+	api.postEntity(w, r, r.PathParam("entity"), nil)
+}
+
+// postEntity creates an entity from the payload of r, whose fixed fields are
+// overridden.
+func (api *EntityRestAPI) postEntity(w rest.ResponseWriter, r *rest.Request, entity string, fixed map[string]interface{}) {
 	w.Header().Add("Access-Control-Expose-Headers", StatusCodeHeader)
 	w.Header().Add("Access-Control-Expose-Headers", EntityIDHeader)
 
-	entity := r.PathParam("entity")
+	fail := func(p *Problem) {
+		w.Header().Set(StatusCodeHeader, fmt.Sprintf("%d", p.Status))
+		writeProblem(w, p)
+	}
+
 	postData := map[string]interface{}{}
 	if err := r.DecodeJsonPayload(&postData); err != nil {
-		w.Header().Set(StatusCodeHeader, fmt.Sprintf("%d", http.StatusInternalServerError))
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		fail(NewProblem(http.StatusBadRequest, err.Error()))
 		return
 	}
 
+	for field, value := range fixed {
+		postData[field] = value
+	}
+
 	newId, err := api.em.PostEntity(entity, postData)
 	if err != nil {
-		w.Header().Set(StatusCodeHeader, fmt.Sprintf("%d", http.StatusInternalServerError))
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		fail(api.problemFor(entity, err))
 		return
 	}
 
 	insertedEntity, err := api.em.GetEntity(entity, strconv.FormatInt(newId, 10))
 	if err != nil {
-		w.Header().Set(StatusCodeHeader, fmt.Sprintf("%d", http.StatusInternalServerError))
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		fail(api.problemFor(entity, err))
 		return
 	}
 
 	w.Header().Set(LocationHeader, fmt.Sprintf("%s/%d", entity, newId))
 	w.Header().Set(StatusCodeHeader, fmt.Sprintf("%d", http.StatusCreated))
 	w.Header().Set(EntityIDHeader, fmt.Sprintf("%d", newId))
+	w.Header().Set(ETagHeader, api.em.EntityTag(entity, insertedEntity))
 
 	w.WriteHeader(http.StatusCreated)
 	w.WriteJson(insertedEntity)
 }
 
 func (api *EntityRestAPI) PutEntity(w rest.ResponseWriter, r *rest.Request) {
-	id := r.PathParam("id")
-	entity := r.PathParam("entity")
+	if !api.checkOperation(w, r.PathParam("entity"), Update) {
+		return
+	}
+
+	api.updateEntity(w, r, r.PathParam("entity"), r.PathParam("id"), nil)
+}
+
+// PatchEntity behaves like PutEntity: only the fields present in the payload
+// are updated.
+func (api *EntityRestAPI) PatchEntity(w rest.ResponseWriter, r *rest.Request) {
+	api.PutEntity(w, r)
+}
+
+// updateEntity updates the entity with the given id from the payload of r,
+// provided its fixed fields have the given values, which cannot be changed.
+func (api *EntityRestAPI) updateEntity(w rest.ResponseWriter, r *rest.Request, entity string, id string, fixed map[string]interface{}) {
 	updated := map[string]interface{}{}
 	if err := r.DecodeJsonPayload(&updated); err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		writeProblem(w, NewProblem(http.StatusBadRequest, err.Error()))
 		return
 	}
 
-	rowsAffected, updatedEntity, err := api.em.UpdateEntity(entity, id, updated)
+	var rowsAffected int64
+	var updatedEntity map[string]interface{}
+
+	err := api.em.InTransaction(func(txm eram.EntityManager) error {
+		if ok, err := hasFields(txm, entity, id, fixed); err != nil || !ok {
+			return err
+		}
+
+		for field := range fixed {
+			delete(updated, field)
+		}
+
+		var err error
+		rowsAffected, updatedEntity, err = txm.UpdateEntityIfMatch(entity, id, updated, r.Header.Get(IfMatchHeader))
+		return err
+	})
 	if err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		api.writeError(w, entity, err)
 		return
 	} else if len(updatedEntity) <= 0 {
-		rest.Error(w, "Not Found", http.StatusNotFound)
+		writeProblem(w, notFound(entity, id))
 		return
 	}
 
+	w.Header().Set(ETagHeader, api.em.EntityTag(entity, updatedEntity))
+
 	if rowsAffected == 0 {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
@@ -152,17 +227,191 @@ func (api *EntityRestAPI) PutEntity(w rest.ResponseWriter, r *rest.Request) {
 }
 
 func (api *EntityRestAPI) DeleteEntity(w rest.ResponseWriter, r *rest.Request) {
-	id := r.PathParam("id")
-	entity := r.PathParam("entity")
-	rowsAffected, err := api.em.DeleteEntity(entity, id)
+	if !api.checkOperation(w, r.PathParam("entity"), Delete) {
+		return
+	}
+
+	api.deleteEntity(w, r, r.PathParam("entity"), r.PathParam("id"), nil)
+}
+
+// deleteEntity deletes the entity with the given id, provided its fixed
+// fields have the given values.
+func (api *EntityRestAPI) deleteEntity(w rest.ResponseWriter, r *rest.Request, entity string, id string, fixed map[string]interface{}) {
+	var rowsAffected int64
+
+	err := api.em.InTransaction(func(txm eram.EntityManager) error {
+		if ok, err := hasFields(txm, entity, id, fixed); err != nil || !ok {
+			return err
+		}
+
+		var err error
+		rowsAffected, err = txm.DeleteEntityIfMatch(entity, id, r.Header.Get(IfMatchHeader))
+		return err
+	})
 	if err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		api.writeError(w, entity, err)
 		return
 	}
 
 	if rowsAffected == 0 {
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, notFound(entity, id))
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// RestoreEntity undoes the soft deletion of an entity.
+func (api *EntityRestAPI) RestoreEntity(w rest.ResponseWriter, r *rest.Request) {
+	id := r.PathParam("id")
+	entity := r.PathParam("entity")
+	if !api.checkOperation(w, entity, Delete) {
+		return
+	}
+
+	restorer, ok := api.em.(eram.Restorer)
+	if !ok {
+		writeProblem(w, notImplemented("restoring entities"))
+		return
+	}
+
+	rowsAffected, err := restorer.RestoreEntity(entity, id)
+	if err != nil {
+		api.writeError(w, entity, err)
+		return
+	} else if rowsAffected == 0 {
+		writeProblem(w, notFound(entity, id))
+		return
+	}
+
+	restored, err := api.em.GetEntity(entity, id)
+	if err != nil {
+		api.writeError(w, entity, err)
+		return
+	}
+
+	w.Header().Set(ETagHeader, api.em.EntityTag(entity, restored))
+	w.WriteJson(restored)
+}
+
+// VerifyEntity checks the values of the payload against the stored fields of
+// an entity, e.g. a password against its hash, without returning them.
+func (api *EntityRestAPI) VerifyEntity(w rest.ResponseWriter, r *rest.Request) {
+	id := r.PathParam("id")
+	entity := r.PathParam("entity")
+	if !api.checkOperation(w, entity, Read) {
+		return
+	}
+
+	candidates := map[string]interface{}{}
+	if err := r.DecodeJsonPayload(&candidates); err != nil {
+		writeProblem(w, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	verifier, ok := api.em.(eram.EntityVerifier)
+	if !ok {
+		writeProblem(w, notImplemented("verifying entities"))
+		return
+	}
+
+	verified, found, err := verifier.VerifyEntity(entity, id, candidates)
+	if err != nil {
+		api.writeError(w, entity, err)
+		return
+	} else if !found {
+		writeProblem(w, notFound(entity, id))
+		return
+	}
+
+	w.WriteJson(map[string]bool{"verified": verified})
+}
+
+// listQuery removes the parameters selecting a page of rows from qs, and
+// returns the matching query, filtered by the remaining parameters.
+func listQuery(qs url.Values) (eram.Query, error) {
+	query := eram.Query{SortField: qs.Get("_sortField"), SortDir: qs.Get("_sortDir")}
+	if query.SortField == "" {
+		query.SortField = qs.Get("_sort")
+	}
+
+	limit, offset := qs.Get("_perPage"), qs.Get("_page")
+	if limit == "" {
+		limit = Limit
+	}
+
+	if offset == "" {
+		offset = Offset
+	}
+
+	qs.Del("_perPage")
+	qs.Del("_page")
+	qs.Del("_sortField")
+	qs.Del("_sort")
+	qs.Del("_sortDir")
+
+	query.Options = readOptions(qs)
+
+	// remaining GET parameters are used to filter the result
+	query.Filters = make(map[string]string)
+	for filterName := range qs {
+		query.Filters[filterName] = qs.Get(filterName)
+	}
+
+	var err error
+	if query.Limit, err = strconv.Atoi(limit); err != nil {
+		return query, &eram.QueryError{Param: "_perPage", Message: "must be an integer"}
+	} else if query.Offset, err = strconv.Atoi(offset); err != nil {
+		return query, &eram.QueryError{Param: "_page", Message: "must be an integer"}
+	}
+
+	return query, nil
+}
+
+// readOptions removes the parameters shaping the returned rows from qs and
+// returns the matching read options.
+func readOptions(qs url.Values) []eram.ReadOption {
+	withDeleted, _ := strconv.ParseBool(qs.Get("_withDeleted"))
+	onlyDeleted, _ := strconv.ParseBool(qs.Get("_onlyDeleted"))
+	fields := splitList(qs.Get("_fields"))
+	embeds := append(splitList(qs.Get("_expand")), splitList(qs.Get("_embed"))...)
+	search := strings.TrimSpace(qs.Get("_q"))
+
+	qs.Del("_withDeleted")
+	qs.Del("_onlyDeleted")
+	qs.Del("_fields")
+	qs.Del("_expand")
+	qs.Del("_embed")
+	qs.Del("_q")
+
+	options := []eram.ReadOption{eram.Deleted(eram.ExcludeDeleted)}
+	if onlyDeleted {
+		options[0] = eram.Deleted(eram.OnlyDeleted)
+	} else if withDeleted {
+		options[0] = eram.Deleted(eram.WithDeleted)
+	}
+
+	if len(fields) > 0 {
+		options = append(options, eram.Fields(fields...))
+	}
+
+	if len(embeds) > 0 {
+		options = append(options, eram.Embed(embeds...))
+	}
+
+	if search != "" {
+		options = append(options, eram.Search(search))
+	}
+
+	return options
+}
+
+// splitList splits a comma separated parameter, ignoring empty items.
+func splitList(param string) []string {
+	var items []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
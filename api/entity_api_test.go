@@ -1,22 +1,33 @@
 package api
 
 import (
+	"bytes"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	eram "github.com/Onefootball/entity-rest-api/manager"
 	erat "github.com/Onefootball/entity-rest-api/test"
 	"github.com/ant0ine/go-json-rest/rest"
 	_ "github.com/mattn/go-sqlite3"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
-	server  *httptest.Server
-	handler http.Handler
+	server        *httptest.Server
+	handler       http.Handler
+	database      *sql.DB
+	entityManager *eram.EntityDbManager
 )
 
 type User struct {
@@ -57,18 +68,118 @@ func init() {
 		}
 	}
 
+	database = db
+
 	api := rest.NewApi()
 	api.Use(rest.DefaultDevStack...)
 
-	entityManager := eram.NewEntityDbManager(db)
+	entityManager = eram.NewEntityDbManager(db)
+	entityManager.SetLastModifiedColumn("post", "update_time")
+	entityManager.SetSoftDelete("comment", "deleted_at", eram.SoftDeleteTimestamp)
+	entityManager.AddRule("comment", "email", eram.Email())
+	entityManager.AddForeignKey(eram.ForeignKey{
+		Entity:           "comment",
+		Column:           "author",
+		References:       "user",
+		ReferencedColumn: "username",
+	})
+	entityManager.AddJoinTable(eram.JoinTable{
+		Table:        "post_tag",
+		Entity:       "post",
+		Column:       "post_id",
+		Target:       "tag",
+		TargetColumn: "tag_id",
+	})
+	entityManager.SetDeletePolicy("user", "post", eram.Restrict)
+	entityManager.SetDeletePolicy("post", "comment", eram.Cascade)
+	entityManager.SetDeletePolicy("post", "tag", eram.Cascade)
+	entityManager.SetFoldAccents(true)
+	entityManager.RegisterQuery(
+		"lookups_from",
+		"SELECT name, code FROM lookup WHERE type = :type AND code >= :code",
+		eram.QueryParam{Name: "code", Type: eram.IntegerParam},
+	)
+	entityManager.RegisterProcedure("close_month", eram.Procedure{Params: []string{"year", "month"}})
+	entityManager.SetSearchIndex("post", eram.SearchIndex{Columns: []string{"title", "content"}})
+	entityManager.SetEncryptedField("comment", "email", eram.Encryption{
+		Keys: &eram.StaticKeys{
+			Current: "2",
+			Keys: map[string][]byte{
+				"1": []byte("0123456789abcdef0123456789abcdef"),
+				"2": []byte("fedcba9876543210fedcba9876543210"),
+			},
+		},
+		BlindIndex: "email_index",
+		IndexKey:   []byte("blind index key"),
+	})
+	entityManager.AddVirtualField("post", eram.VirtualField{
+		Name: "comment_count",
+		Expr: "SELECT COUNT(*) FROM `comment` WHERE `comment`.`post_id` = `post`.`id`",
+	})
+	entityManager.AddVirtualField("user", eram.VirtualField{
+		Name: "display_name",
+		Func: func(row map[string]interface{}) interface{} {
+			return fmt.Sprintf("%v (%v)", row["username"], row["email"])
+		},
+	})
+	entityManager.SetFieldTransformer("user", "password", eram.Argon2id(eram.Argon2Params{
+		Time:       1,
+		Memory:     1024,
+		Threads:    1,
+		KeyLength:  32,
+		SaltLength: 16,
+	}))
+	entityManager.AddHook("tag", eram.BeforeCreate, func(hc *eram.HookContext) error {
+		name := fmt.Sprintf("%v", hc.Data["name"])
+		if name == "forbidden" {
+			return &eram.HookError{Status: http.StatusForbidden, Message: "This tag is forbidden."}
+		}
+		hc.Data["name"] = strings.ToLower(name)
+		return nil
+	})
+	entityManager.AddHook("tag", eram.AfterCreate, func(hc *eram.HookContext) error {
+		if hc.Row["name"] == "rollback" {
+			return &eram.HookError{Status: http.StatusConflict, Message: "This tag is rolled back."}
+		}
+		return nil
+	})
+	entityManager.AddHook("tag", eram.AfterRead, func(hc *eram.HookContext) error {
+		if strings.HasPrefix(fmt.Sprintf("%v", hc.Row["name"]), "secret") {
+			hc.Row["name"] = "[redacted]"
+		}
+		return nil
+	})
+	entityManager.SetTimestampColumns("post", eram.TimestampColumns{
+		Created: "create_time",
+		Updated: "update_time",
+		Format:  eram.TimestampEpoch,
+	})
+
 	entityRestApi := NewEntityRestAPI(entityManager)
+	entityRestApi.SetCacheControl("tag", "max-age=60")
+	entityRestApi.SetOperations("lookup", List, Read, Create, Update)
 
 	router, err := rest.MakeRouter(
+		rest.Post("/api/_batch", entityRestApi.PostBatch),
+		rest.Get("/api/_query/:name", entityRestApi.RunQuery),
+		rest.Post("/api/_rpc/:name", entityRestApi.CallProcedure),
 		rest.Get("/api/:entity", entityRestApi.GetAllEntities),
+		rest.Get("/api/:entity/_aggregate", entityRestApi.AggregateEntities),
+		rest.Get("/api/:entity/_facets", entityRestApi.FacetEntities),
 		rest.Post("/api/:entity", entityRestApi.PostEntity),
 		rest.Get("/api/:entity/:id", entityRestApi.GetEntity),
 		rest.Put("/api/:entity/:id", entityRestApi.PutEntity),
+		rest.Patch("/api/:entity/:id", entityRestApi.PatchEntity),
 		rest.Delete("/api/:entity/:id", entityRestApi.DeleteEntity),
+		rest.Post("/api/:entity/:id/_restore", entityRestApi.RestoreEntity),
+		rest.Post("/api/:entity/:id/_verify", entityRestApi.VerifyEntity),
+		rest.Get("/api/:entity/:id/:child", entityRestApi.GetAllChildren),
+		rest.Post("/api/:entity/:id/:child", entityRestApi.PostChild),
+		rest.Put("/api/:entity/:id/:child", entityRestApi.PutAllChildren),
+		rest.Get("/api/:entity/:id/:child/:childId", entityRestApi.GetChild),
+		rest.Put("/api/:entity/:id/:child/:childId", entityRestApi.PutChild),
+		rest.Patch("/api/:entity/:id/:child/:childId", entityRestApi.PatchChild),
+		rest.Delete("/api/:entity/:id/:child/:childId", entityRestApi.DeleteChild),
 	)
 
 	if err != nil {
@@ -146,9 +257,9 @@ func TestGETEntityThatExistsReturn200WithJson(t *testing.T) {
 	}
 }
 
-func TestPOSTWithInvalidEntityShouldReturn400(t *testing.T) {
+func TestPOSTWithInvalidEntityShouldReturn422(t *testing.T) {
 
-	// This post doesn't have title and should be wrong then
+	// This post doesn't have status nor author and should be wrong then
 	entity := map[string]string{"title": "Test Post 1", "content": "not enought data"}
 
 	recorded := erat.RunRequest(
@@ -156,7 +267,16 @@ func TestPOSTWithInvalidEntityShouldReturn400(t *testing.T) {
 		handler,
 		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post", server.URL), entity))
 
-	t.Skipf("Invalid POST should return 400 but it is returning %d", recorded.Recorder.Code)
+	recorded.CodeIs(422)
+	recorded.HeaderIs("Content-Type", ProblemContentType)
+	recorded.HeaderIs(StatusCodeHeader, "422")
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Error(err)
+	} else if len(problem.Errors) == 0 {
+		t.Error("The problem should list the missing field.")
+	}
 }
 
 func TestPOSTWithExistingEntryShouldReturn409(t *testing.T) {
@@ -175,7 +295,8 @@ func TestPOSTWithExistingEntryShouldReturn409(t *testing.T) {
 		handler,
 		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post", server.URL), entity))
 
-	t.Skipf("Invalid code, should be 409 as a conflict for the ID 1 but get %d", recorded.Recorder.Code)
+	recorded.CodeIs(409)
+	recorded.HeaderIs("Content-Type", ProblemContentType)
 }
 
 func TestPOSTWithValidEntityShouldReturn201WithHeader(t *testing.T) {
@@ -199,13 +320,23 @@ func TestPOSTWithValidEntityShouldReturn201WithHeader(t *testing.T) {
 	recorded.HeaderIs(StatusCodeHeader, "201")
 }
 
-/**
- * right now the PUT request return 200 even if you send problematic JSONs
- * to beign inserted, which means a false-positive, but not dangerous mistakes
- * it is just a matter of make the API more understandable and easy to debug
- */
-func TestPUTWithInvalidEntityShouldReturn400(t *testing.T) {
-	t.Skip("PUT request should make validations, not allow fake 200")
+func TestPUTWithInvalidEntityShouldReturn422(t *testing.T) {
+
+	entity := map[string]interface{}{"status": "published", "title": nil}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/%d", server.URL, 10), entity))
+
+	recorded.CodeIs(422)
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Error(err)
+	} else if len(problem.Errors) != 2 {
+		t.Errorf("Both status and title should be invalid. %v", problem.Errors)
+	}
 }
 
 func TestPUTWithNoEntityChangeShouldReturn204(t *testing.T) {
@@ -363,3 +494,2306 @@ func TestGETWithMultipleColumnFiltersShouldReturn200WithSet(t *testing.T) {
 		}
 	}
 }
+
+func TestPOSTBatchShouldResolveReferencesAndReturn200(t *testing.T) {
+
+	operations := []map[string]interface{}{
+		{"method": "create", "entity": "post", "data": map[string]interface{}{
+			"title": "Batch Post", "content": "<p>batch</p>", "status": 1, "author_id": 1}},
+		{"method": "create", "entity": "comment", "data": map[string]interface{}{
+			"content": "batch comment", "status": 1, "author": "demo", "email": "demo@example.com", "post_id": "$1.id"}},
+	}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/_batch", server.URL), operations))
+
+	recorded.CodeIs(200)
+
+	data := []BatchResult{}
+	err := recorded.DecodeJsonPayload(&data)
+
+	if err != nil {
+		t.Error(err)
+	} else {
+
+		if len(data) != 2 {
+			t.Fatalf("Should have returned 2 results, got %d.", len(data))
+		}
+
+		if data[0].Status != 201 || data[1].Status != 201 {
+			t.Errorf("Both operations should have been created. %v", data)
+		}
+
+		if data[1].Data["post_id"] != data[0].Data["id"] {
+			t.Error("The comment should reference the post created in the same batch.")
+		}
+	}
+}
+
+func TestPOSTBatchShouldRollbackOnFailure(t *testing.T) {
+
+	operations := []map[string]interface{}{
+		{"method": "create", "entity": "tag", "data": map[string]interface{}{"name": "rolledback"}},
+		{"method": "update", "entity": "tag", "id": 999, "data": map[string]interface{}{"name": "missing"}},
+	}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/_batch", server.URL), operations))
+
+	recorded.CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag?name=rolledback", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs("[]")
+}
+
+func TestPOSTBatchShouldRejectIdsThatAreNotIntegers(t *testing.T) {
+
+	for _, method := range []string{"update", "delete"} {
+		operations := []map[string]interface{}{
+			{"method": method, "entity": "tag", "id": "0 OR 1=1", "data": map[string]interface{}{"name": "pwned"}},
+		}
+
+		recorded := erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/_batch", server.URL), operations))
+
+		recorded.CodeIs(400)
+	}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag?name=pwned", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs("[]")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag/1", server.URL), nil))
+
+	recorded.CodeIs(200)
+}
+
+func TestPUTWithStaleIfMatchShouldReturn412(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag/1", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	etag := recorded.Recorder.HeaderMap.Get(ETagHeader)
+	if etag == "" {
+		t.Fatal("GET should have returned an ETag.")
+	}
+
+	request := erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/tag/1", server.URL), map[string]string{"name": "announce"})
+	request.Header.Set(IfMatchHeader, etag)
+
+	recorded = erat.RunRequest(t, handler, request)
+	recorded.CodeIs(200)
+
+	request = erat.MakeSimpleRequest("PATCH", fmt.Sprintf("%s/api/tag/1", server.URL), map[string]string{"name": "announce"})
+	request.Header.Set(IfMatchHeader, "\"stale\"")
+
+	recorded = erat.RunRequest(t, handler, request)
+	recorded.CodeIs(412)
+}
+
+func TestDELETEWithStaleIfMatchShouldReturn412(t *testing.T) {
+
+	request := erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/tag/1", server.URL), nil)
+	request.Header.Set(IfMatchHeader, "\"stale\"")
+
+	recorded := erat.RunRequest(t, handler, request)
+	recorded.CodeIs(412)
+}
+
+func TestGETWithMatchingIfNoneMatchShouldReturn304(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs(CacheControlHeader, "max-age=60")
+
+	request := erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag", server.URL), nil)
+	request.Header.Set(IfNoneMatchHeader, recorded.Recorder.HeaderMap.Get(ETagHeader))
+
+	recorded = erat.RunRequest(t, handler, request)
+	recorded.CodeIs(304)
+	recorded.BodyIs("")
+}
+
+func TestGETWithIfModifiedSinceShouldReturn304(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs(LastModifiedHeader, "Sat, 03 Jan 2009 03:09:47 GMT")
+
+	request := erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1", server.URL), nil)
+	request.Header.Set(IfModifiedSinceHeader, "Sat, 03 Jan 2009 03:09:47 GMT")
+
+	recorded = erat.RunRequest(t, handler, request)
+	recorded.CodeIs(304)
+
+	request = erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1", server.URL), nil)
+	request.Header.Set(IfModifiedSinceHeader, "Fri, 02 Jan 2009 00:00:00 GMT")
+
+	recorded = erat.RunRequest(t, handler, request)
+	recorded.CodeIs(200)
+
+	// a list may change without its newest row changing
+	request = erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post", server.URL), nil)
+	request.Header.Set(IfModifiedSinceHeader, time.Now().UTC().Format(http.TimeFormat))
+
+	recorded = erat.RunRequest(t, handler, request)
+	recorded.CodeIs(200)
+	recorded.HeaderIs(LastModifiedHeader, "")
+}
+
+func TestDELETEWithSoftDeleteShouldHideAndRestoreEntity(t *testing.T) {
+
+	comment := map[string]interface{}{
+		"content": "soft deleted", "status": 1, "author": "demo", "email": "demo@example.com", "post_id": 1}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment", server.URL), comment))
+
+	recorded.CodeIs(201)
+	id := recorded.Recorder.HeaderMap.Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/comment/%s", server.URL, id), nil))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment/%s", server.URL, id), nil))
+
+	recorded.CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment?_onlyDeleted=true", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Error(err)
+	} else if len(data) != 1 || fmt.Sprintf("%v", data[0]["id"]) != id {
+		t.Errorf("Only the deleted comment should have been found. %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment/%s/_restore", server.URL, id), nil))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment/%s", server.URL, id), nil))
+
+	recorded.CodeIs(200)
+}
+
+func TestSoftDeleteShouldExcludeDeletedTargetsOfJoinTablesWithTheSameColumn(t *testing.T) {
+
+	for _, statement := range []string{
+		"CREATE TABLE club ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name VARCHAR(128) NOT NULL, deleted_at DATETIME )",
+		"CREATE TABLE member ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name VARCHAR(128) NOT NULL, deleted_at DATETIME )",
+		"CREATE TABLE club_member ( club_id INTEGER NOT NULL, member_id INTEGER NOT NULL, deleted_at DATETIME, PRIMARY KEY (club_id, member_id) )",
+		"INSERT INTO club (name) VALUES ('chess')",
+		"INSERT INTO member (name) VALUES ('alice')",
+		"INSERT INTO member (name, deleted_at) VALUES ('bob', '2016-01-01 00:00:00')",
+		"INSERT INTO club_member (club_id, member_id) VALUES (1, 1), (1, 2)",
+	} {
+		if _, err := database.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer database.Exec("DROP TABLE club_member")
+	defer database.Exec("DROP TABLE member")
+	defer database.Exec("DROP TABLE club")
+
+	em := eram.NewEntityDbManager(database)
+	em.AddJoinTable(eram.JoinTable{Table: "club_member", Entity: "club", Column: "club_id", Target: "member", TargetColumn: "member_id"})
+	em.SetSoftDelete("member", "deleted_at", eram.SoftDeleteTimestamp)
+
+	club, err := em.GetEntity("club", "1", eram.Embed("member"), eram.Fields("id", "member.name"))
+	if err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprintf("%v", club["member"]) != "[map[name:alice]]" {
+		t.Errorf("Only the live member should have been embedded, got %v", club)
+	}
+}
+
+func TestPOSTShouldIgnoreClientTimestamps(t *testing.T) {
+
+	entity := map[string]interface{}{
+		"title": "Timestamped", "content": "<p>now</p>", "status": 1, "author_id": 1, "create_time": 1, "update_time": 1}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post", server.URL), entity))
+
+	recorded.CodeIs(201)
+
+	data := Post{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(time.Unix(int64(data.Create_Time), 0)) > time.Minute {
+		t.Errorf("The creation time should have been set by the manager, got %d.", data.Create_Time)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/%d", server.URL, data.Id), map[string]interface{}{"title": "Retimestamped", "create_time": 1}))
+
+	recorded.CodeIs(200)
+
+	updated := Post{}
+	if err := recorded.DecodeJsonPayload(&updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Create_Time != data.Create_Time {
+		t.Error("The creation time should not be updated by clients.")
+	}
+}
+
+func TestGETWithUnknownEntityShouldReturn404Problem(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/unknown", server.URL), nil))
+
+	recorded.CodeIs(404)
+	recorded.HeaderIs("Content-Type", ProblemContentType)
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Error(err)
+	} else if problem.Status != 404 || problem.Detail != "Entity 'unknown' does not exist." {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+}
+
+func TestPOSTShouldReturn422ListingEveryInvalidField(t *testing.T) {
+
+	comment := map[string]interface{}{
+		"content": "invalid", "status": 1.5, "author": strings.Repeat("a", 129), "email": "not an email", "post_id": 1, "unknown": true}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment", server.URL), comment))
+
+	recorded.CodeIs(422)
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{}
+	for _, fieldProblem := range problem.Errors {
+		fields = append(fields, fieldProblem.Field)
+	}
+
+	if strings.Join(fields, ",") != "author,email,status,unknown" {
+		t.Errorf("Unexpected invalid fields %v", problem.Errors)
+	}
+}
+
+func TestPOSTWithHooksShouldMutateOrVetoEntity(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/tag", server.URL), map[string]string{"name": "Hooked"}))
+
+	recorded.CodeIs(201)
+
+	data := Tag{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Error(err)
+	} else if data.Name != "hooked" {
+		t.Errorf("The BeforeCreate hook should have lowercased the name, got %s.", data.Name)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/tag", server.URL), map[string]string{"name": "forbidden"}))
+
+	recorded.CodeIs(403)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/tag", server.URL), map[string]string{"name": "rollback"}))
+
+	recorded.CodeIs(409)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag?name=rollback", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs("[]")
+}
+
+func TestGETWithVirtualFieldsShouldReturnRequestedFields(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/user/1?_fields=id,display_name", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{
+  "display_name": "demo (webmaster@example.com)",
+  "id": 1
+}`)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post?_fields=*,comment_count&_sortField=comment_count&_sortDir=DESC&comment_count=0", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) == 0 {
+		t.Fatal("Should have found posts without comments.")
+	}
+
+	for _, post := range data {
+		if post["comment_count"] != float64(0) || post["title"] == nil {
+			t.Errorf("Unexpected post %v", post)
+		}
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/user?display_name=demo", server.URL), nil))
+
+	recorded.CodeIs(400)
+}
+
+func TestPOSTWithHashedFieldShouldNeverReturnItButVerifyIt(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/user", server.URL), map[string]interface{}{
+			"username": "hashed",
+			"password": "s3cret",
+			"salt":     "",
+			"email":    "hashed@example.com",
+		}))
+
+	recorded.CodeIs(201)
+
+	data := map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := data["password"]; ok {
+		t.Error("The password should not be returned.")
+	}
+
+	id := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/user/%s/_verify", server.URL, id), map[string]interface{}{
+			"password": "s3cret",
+		}))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{
+  "verified": true
+}`)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/user/%s/_verify", server.URL, id), map[string]interface{}{
+			"password": "wrong",
+		}))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{
+  "verified": false
+}`)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/user/%s/_verify", server.URL, id), map[string]interface{}{
+			"username": "hashed",
+		}))
+
+	recorded.CodeIs(400)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/user?password=s3cret", server.URL), nil))
+
+	recorded.CodeIs(400)
+}
+
+func TestPOSTWithBcryptFieldShouldRejectPasswordsBcryptCannotHash(t *testing.T) {
+
+	em := eram.NewEntityDbManager(database)
+	em.SetFieldTransformer("user", "password", eram.Bcrypt(4))
+
+	user := map[string]interface{}{"username": "bcrypt", "salt": "", "email": "bcrypt@example.com"}
+
+	user["password"] = strings.Repeat("x", 73)
+	_, err := em.PostEntity("user", user)
+
+	var validationErr *eram.ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 1 || validationErr.Fields[0].Field != "password" {
+		t.Errorf("A password of 73 bytes should have been rejected, got %v", err)
+	} else if problem := NewEntityRestAPI(em).problemFor("user", err); problem.Status != 422 {
+		t.Errorf("A password of 73 bytes should be unprocessable, got %v", problem)
+	}
+
+	user["password"] = strings.Repeat("x", 72)
+	if _, err := em.PostEntity("user", user); err != nil {
+		t.Errorf("A password of 72 bytes should have been hashed, got %v", err)
+	}
+}
+
+func TestPOSTWithEncryptedFieldShouldStoreCiphertextAndFilterOnBlindIndex(t *testing.T) {
+
+	comment := map[string]interface{}{
+		"content": "encrypted", "status": 1, "author": "demo", "email": "secret@example.com", "post_id": 1}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment", server.URL), comment))
+
+	recorded.CodeIs(201)
+	id := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	var stored string
+	if err := database.QueryRow("SELECT email FROM comment WHERE id = ?", id).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(stored, "enc:2:") || strings.Contains(stored, "secret") {
+		t.Errorf("The email should have been stored encrypted, got %s", stored)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment?email=secret@example.com", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 1 || data[0]["email"] != "secret@example.com" {
+		t.Errorf("The comment should have been found with its plaintext email, got %v", data)
+	} else if _, ok := data[0]["email_index"]; ok {
+		t.Error("The blind index should not be returned.")
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment?email=secret*", server.URL), nil))
+
+	recorded.CodeIs(400)
+}
+
+func TestEncryptedFieldShouldBeReadableAndReencryptedAfterKeyRotation(t *testing.T) {
+
+	em := eram.NewEntityDbManager(database)
+	em.SetEncryptedField("comment", "email", eram.Encryption{
+		Keys: &eram.StaticKeys{
+			Current: "1",
+			Keys:    map[string][]byte{"1": []byte("0123456789abcdef0123456789abcdef")},
+		},
+		BlindIndex: "email_index",
+		IndexKey:   []byte("blind index key"),
+	})
+
+	id, err := em.PostEntity("comment", map[string]interface{}{
+		"content": "rotated", "status": 1, "author": "demo", "email": "rotated@example.com", "post_id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func() string {
+		var email string
+		if err := database.QueryRow("SELECT email FROM comment WHERE id = ?", id).Scan(&email); err != nil {
+			t.Fatal(err)
+		}
+		return email
+	}
+
+	if !strings.HasPrefix(stored(), "enc:1:") {
+		t.Fatalf("The email should have been encrypted with the old key, got %s", stored())
+	}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment/%d", server.URL, id), nil))
+
+	recorded.CodeIs(200)
+
+	data := map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if data["email"] != "rotated@example.com" {
+		t.Errorf("The email encrypted with the old key should have been decrypted, got %v", data["email"])
+	}
+
+	if updated, err := entityManager.ReencryptEntity("comment"); err != nil {
+		t.Fatal(err)
+	} else if updated == 0 {
+		t.Error("The comment encrypted with the old key should have been re-encrypted.")
+	}
+
+	if !strings.HasPrefix(stored(), "enc:2:") {
+		t.Errorf("The email should have been re-encrypted with the current key, got %s", stored())
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment?email=rotated@example.com", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	list := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&list); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0]["email"] != "rotated@example.com" {
+		t.Errorf("The re-encrypted comment should have been found with its plaintext email, got %v", list)
+	}
+}
+
+func TestEncryptedFieldShouldReadAndReencryptPlaintextThatLooksEncrypted(t *testing.T) {
+
+	result, err := database.Exec("INSERT INTO comment (content, status, author, email, post_id) VALUES ('legacy', 1, 'demo', 'enc:legacy', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Exec("DELETE FROM comment WHERE id = ?", id)
+
+	get := func() {
+		recorded := erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment/%d", server.URL, id), nil))
+
+		recorded.CodeIs(200)
+
+		data := map[string]interface{}{}
+		if err := recorded.DecodeJsonPayload(&data); err != nil {
+			t.Fatal(err)
+		} else if data["email"] != "enc:legacy" {
+			t.Errorf("The plaintext email should have been returned as is, got %v", data["email"])
+		}
+	}
+
+	get()
+
+	if _, err := entityManager.ReencryptEntity("comment"); err != nil {
+		t.Fatal(err)
+	}
+
+	var email string
+	if err := database.QueryRow("SELECT email FROM comment WHERE id = ?", id).Scan(&email); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(email, "enc:2:") {
+		t.Errorf("The plaintext email should have been encrypted with the current key, got %s", email)
+	}
+
+	get()
+}
+
+func TestPOSTWithEncryptedFieldShouldCheckTheLengthOfTheCiphertext(t *testing.T) {
+
+	// 63 bytes, whose ciphertext exceeds the 128 characters of the column
+	email := strings.Repeat("a", 51) + "@example.com"
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment", server.URL), map[string]interface{}{
+			"content": "too long", "status": 1, "author": "demo", "email": email, "post_id": 1}))
+
+	recorded.CodeIs(422)
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Fatal(err)
+	} else if len(problem.Errors) != 1 || problem.Errors[0].Field != "email" {
+		t.Errorf("The email should have been rejected, got %v", problem.Errors)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment", server.URL), map[string]interface{}{
+			"content": "long enough", "status": 1, "author": "demo", "email": email[1:], "post_id": 1}))
+
+	recorded.CodeIs(201)
+}
+
+func TestRelationshipsShouldIncludeDiscoveredAndDeclaredForeignKeys(t *testing.T) {
+
+	relationships, err := entityManager.Relationships("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, r := range relationships {
+		names = append(names, fmt.Sprintf("%s:%d:%s.%s", r.Name, r.Kind, r.Target, r.TargetColumn()))
+	}
+
+	if strings.Join(names, ",") != "comment:1:comment.author,post:1:post.author_id" {
+		t.Errorf("Unexpected relationships of user: %v", names)
+	}
+
+	author, err := entityManager.Relationship("post", "author")
+	if err != nil {
+		t.Fatal(err)
+	} else if author.Kind != eram.ManyToOne || author.Target != "user" || author.LocalColumn() != "author_id" || author.TargetColumn() != "id" {
+		t.Errorf("Unexpected author relationship of post: %+v", author)
+	}
+
+	if _, err := entityManager.Relationship("post", "unknown"); err == nil {
+		t.Error("Unknown relationships should not be found.")
+	}
+}
+
+func TestGETWithExpandAndEmbedShouldReturnRelatedEntities(t *testing.T) {
+
+	comment := map[string]interface{}{
+		"content": "embedded", "status": 1, "author": "demo", "email": "embedded@example.com", "post_id": 2}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/comment", server.URL), comment))
+
+	recorded.CodeIs(201)
+	id := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post?_expand=author&_fields=id,author.username&_perPage=2", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs(`[
+  {
+    "author": {
+      "username": "demo"
+    },
+    "id": 1
+  },
+  {
+    "author": {
+      "username": "demo"
+    },
+    "id": 2
+  }
+]`)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/2?_embed=comment.post.author&_fields=id,comment.id,comment.post.title,comment.post.author.email", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs(fmt.Sprintf(`{
+  "comment": [
+    {
+      "id": %s,
+      "post": {
+        "author": {
+          "email": "webmaster@example.com"
+        },
+        "title": "A Test Post"
+      }
+    }
+  ],
+  "id": 2
+}`, id))
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1?_expand=author", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	post := map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&post); err != nil {
+		t.Fatal(err)
+	}
+
+	author, ok := post["author"].(map[string]interface{})
+	if !ok || author["username"] != "demo" || post["author_id"] == nil {
+		t.Errorf("The post should have been returned with its author, got %v", post)
+	} else if _, ok := author["password"]; ok {
+		t.Error("The password of the author should not be returned.")
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1?_expand=unknown", server.URL), nil))
+
+	recorded.CodeIs(400)
+
+	for _, query := range []string{
+		"post/1?_fields=nosuch",
+		"post?_fields=id,nosuch",
+		"post/1?_fields=id,author.username",
+		"post/1?_expand=author&_fields=id,author.nosuch",
+	} {
+		recorded = erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/%s", server.URL, query), nil))
+
+		recorded.CodeIs(400)
+
+		problem := Problem{}
+		if err := recorded.DecodeJsonPayload(&problem); err != nil {
+			t.Fatal(err)
+		} else if len(problem.Errors) != 1 || problem.Errors[0].Field != "_fields" {
+			t.Errorf("%s should have been rejected, got %v", query, problem.Errors)
+		}
+	}
+}
+
+func TestNestedRoutesShouldOnlyReachChildrenOfTheParent(t *testing.T) {
+
+	comment := map[string]interface{}{
+		"content": "nested", "status": 1, "author": "demo", "email": "nested@example.com", "post_id": 1}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post/2/comment", server.URL), comment))
+
+	recorded.CodeIs(201)
+	id := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/2/comment?content=nested", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 1 || fmt.Sprintf("%v", data[0]["id"]) != id || data[0]["post_id"] != float64(2) {
+		t.Errorf("The comment should have been created for post 2, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1/comment?content=nested", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.BodyIs("[]")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/2/comment/%s", server.URL, id), map[string]interface{}{
+			"content": "moved", "post_id": 1,
+		}))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/post/1/comment/%s", server.URL, id), nil))
+
+	recorded.CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/post/2/comment/%s", server.URL, id), nil))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/999/comment", server.URL), nil))
+
+	recorded.CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1/author", server.URL), nil))
+
+	recorded.CodeIs(404)
+}
+
+func TestManyToManyRoutesShouldLinkAndUnlinkEntities(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/1/tag", server.URL), []int{1, 2}))
+
+	recorded.CodeIs(200)
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 2 || data[0]["name"] != "announce" || data[1]["name"] != "blog" {
+		t.Errorf("Post 1 should have been tagged announce and blog, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post/1/tag", server.URL), map[string]interface{}{"id": 3}))
+
+	recorded.CodeIs(201)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post/1/tag", server.URL), map[string]interface{}{"id": 3}))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post/1/tag", server.URL), map[string]interface{}{"id": 999}))
+
+	recorded.CodeIs(422)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/post/1/tag/1", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/post/1/tag/1", server.URL), nil))
+
+	recorded.CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post/1?_embed=tag&_fields=id,tag", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	post := map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&post); err != nil {
+		t.Fatal(err)
+	} else if tags := fmt.Sprintf("%v", post["tag"]); tags != "[map[frequency:1 id:2 name:blog] map[frequency:1 id:3 name:test]]" {
+		t.Errorf("Post 1 should embed the tags blog and test, got %v", tags)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag/3/post?_fields=id", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data = []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 1 || data[0]["id"] != float64(1) {
+		t.Errorf("Tag 3 should be linked to post 1 only, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/1/comment", server.URL), []int{1}))
+
+	recorded.CodeIs(405)
+	recorded.HeaderIs(AllowHeader, "GET, POST")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/1/tag/2", server.URL), map[string]string{"name": "renamed"}))
+
+	recorded.CodeIs(405)
+	recorded.HeaderIs(AllowHeader, "GET, DELETE")
+}
+
+func TestDELETEShouldApplyDeletePoliciesToChildren(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/user", server.URL), map[string]interface{}{
+			"username": "owner", "password": "secret", "salt": "", "email": "owner@example.com"}))
+
+	recorded.CodeIs(201)
+	userId := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/user/%s/post", server.URL, userId), map[string]interface{}{
+			"title": "Owned", "content": "owned", "status": 1}))
+
+	recorded.CodeIs(201)
+	postId := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post/%s/comment", server.URL, postId), map[string]interface{}{
+			"content": "cascaded", "status": 1, "author": "owner", "email": "owner@example.com"}))
+
+	recorded.CodeIs(201)
+	commentId := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post/%s/tag", server.URL, postId), []int{2}))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/user/%s", server.URL, userId), nil))
+
+	recorded.CodeIs(409)
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Fatal(err)
+	} else if len(problem.Errors) != 1 || problem.Errors[0].Field != "post" || problem.Errors[0].Message != fmt.Sprintf("post [%s]", postId) {
+		t.Errorf("The post of the user should restrict its deletion, got %v", problem.Errors)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/post/%s", server.URL, postId), nil))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/comment/%s", server.URL, commentId), nil))
+
+	recorded.CodeIs(404)
+
+	var links int
+	if err := database.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM post_tag WHERE post_id = %s", postId)).Scan(&links); err != nil {
+		t.Fatal(err)
+	} else if links != 0 {
+		t.Errorf("The tags of the post should have been unlinked, got %d links", links)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/user/%s", server.URL, userId), nil))
+
+	recorded.CodeIs(200)
+}
+
+func TestGETAggregateShouldReturnMetricsPerGroup(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_aggregate?groupBy=type&metrics=count(*),max(code),avg(position)&_sortField=count(*)&_sortDir=DESC", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprintf("%v", data) != "[map[avg(position):2 count(*):3 max(code):3 type:PostStatus] map[avg(position):1.5 count(*):2 max(code):2 type:CommentStatus]]" {
+		t.Errorf("The lookups should have been counted per type, got %v", data)
+	}
+
+	// the parameters of lists are not filters
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_aggregate?groupBy=type&_sort=type&_perPage=1&_page=0", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data = []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 2 || data[0]["type"] != "CommentStatus" {
+		t.Errorf("Every type should have been grouped, sorted by type, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_aggregate?groupBy=type&having=count(*)%%3E2", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	data = []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 1 || data[0]["type"] != "PostStatus" {
+		t.Errorf("Only the post statuses should have more than 2 lookups, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_aggregate?metrics=median(code)", server.URL), nil))
+
+	recorded.CodeIs(400)
+
+	problem := Problem{}
+	if err := recorded.DecodeJsonPayload(&problem); err != nil {
+		t.Fatal(err)
+	} else if len(problem.Errors) != 1 || problem.Errors[0].Field != "metrics" {
+		t.Errorf("The metric should have been rejected, got %v", problem.Errors)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_aggregate?groupBy=unknown", server.URL), nil))
+
+	recorded.CodeIs(400)
+}
+
+func TestGETFacetsShouldCountDistinctValuesOfFilteredEntities(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_facets?fields=type,code", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	facets := map[string][]map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&facets); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprintf("%v", facets["type"]) != "[map[count:3 value:PostStatus] map[count:2 value:CommentStatus]]" {
+		t.Errorf("The lookups should have been counted per type, got %v", facets["type"])
+	} else if fmt.Sprintf("%v", facets["code"]) != "[map[count:2 value:1] map[count:2 value:2] map[count:1 value:3]]" {
+		t.Errorf("The lookups should have been counted per code, got %v", facets["code"])
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_facets?fields=type&type=Comment*&_sort=code&_sortDir=DESC&_perPage=1&_page=1", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	facets = map[string][]map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&facets); err != nil {
+		t.Fatal(err)
+	} else if len(facets["type"]) != 1 || facets["type"][0]["value"] != "CommentStatus" {
+		t.Errorf("The facets should have been narrowed to comment statuses, got %v", facets["type"])
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup/_facets", server.URL), nil))
+
+	recorded.CodeIs(400)
+}
+
+func TestGETWithSearchShouldReturnMatchingEntitiesByRelevance(t *testing.T) {
+
+	var ids []string
+	for _, post := range []map[string]interface{}{
+		{"title": "Zebra crossing", "content": "A zebra crossed the road.", "status": 1, "author_id": 1},
+		{"title": "Road works", "content": "No zebra was harmed.", "status": 1, "author_id": 1},
+	} {
+		recorded := erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post", server.URL), post))
+
+		recorded.CodeIs(201)
+		ids = append(ids, recorded.Recorder.Header().Get(EntityIDHeader))
+	}
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post?_q=zebra&_sort=_score&_fields=id", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Total-Count", "2")
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprintf("%v", data) != fmt.Sprintf("[map[id:%s] map[id:%s]]", ids[0], ids[1]) {
+		t.Errorf("The post matching zebra twice should come first, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post?_q=zebra_", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Total-Count", "0")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post?_sort=_score", server.URL), nil))
+
+	recorded.CodeIs(400)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup?_q=draft", server.URL), nil))
+
+	recorded.CodeIs(400)
+
+	// FTS5 is only available when go-sqlite3 is built with the sqlite_fts5 tag
+	if _, err := database.Exec("CREATE VIRTUAL TABLE post_fts USING fts5(title, content, content='post', content_rowid='id')"); err != nil {
+		t.Skipf("FTS5 is not available: %v", err)
+	}
+	defer database.Exec("DROP TABLE post_fts")
+
+	if _, err := database.Exec("INSERT INTO post_fts(post_fts) VALUES('rebuild')"); err != nil {
+		t.Fatal(err)
+	}
+
+	em := eram.NewEntityDbManager(database)
+	em.SetSearchIndex("post", eram.SearchIndex{Columns: []string{"title", "content"}, Index: "post_fts"})
+
+	posts, count, err := em.GetEntities("post", map[string]string{}, "10", "0", eram.ScoreField, "DESC", eram.Search(`zebra "road`))
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 2 || fmt.Sprintf("%v", posts[0]["id"]) != ids[0] {
+		t.Errorf("The FTS5 index should have found both posts, the first one first, got %v", posts)
+	}
+}
+
+func TestGETWithFilterOperatorsShouldMatchConsistently(t *testing.T) {
+
+	for _, name := range []string{"Crème Brûlée", "100% natural", "100 natural"} {
+		recorded := erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/lookup", server.URL), map[string]interface{}{
+				"name": name, "code": 1, "type": "Dessert", "position": 1}))
+
+		recorded.CodeIs(201)
+	}
+
+	for query, expected := range map[string]string{
+		"name__iexact=cr%C3%A8me%20br%C3%BBl%C3%A9e": "[Crème Brûlée]",
+		"name__icontains=BRULEE":                     "[Crème Brûlée]",
+		"name__contains=Br%C3%BBl%C3%A9e":            "[Crème Brûlée]",
+		"name__contains=br%C3%BBl%C3%A9e":            "[]",
+		"name__exact=100%20natural":                  "[100 natural]",
+		"name__contains=%25":                         "[100% natural]",
+		"name__startswith=100_":                      "[]",
+		"name__istartswith=CR%C3%88":                 "[Crème Brûlée]",
+		"name__endswith=natural":                     "[100% natural 100 natural]",
+		"name__ilike=100*NATURAL":                    "[100% natural 100 natural]",
+	} {
+		recorded := erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/lookup?type=Dessert&%s", server.URL, query), nil))
+
+		recorded.CodeIs(200)
+
+		data := []map[string]interface{}{}
+		if err := recorded.DecodeJsonPayload(&data); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []interface{}
+		for _, lookup := range data {
+			names = append(names, lookup["name"])
+		}
+
+		if fmt.Sprintf("%v", names) != expected {
+			t.Errorf("%s should have matched %s, got %v", query, expected, names)
+		}
+	}
+}
+
+func TestOperationsNotAllowedShouldReturn405WithAllowHeader(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/lookup/1", server.URL), nil))
+
+	recorded.CodeIs(405)
+	recorded.HeaderIs(AllowHeader, "GET, PUT, PATCH")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/_batch", server.URL), []BatchOperation{
+			{Method: BatchUpdate, Entity: "lookup", Id: 1, Data: map[string]interface{}{"position": 1}},
+		}))
+
+	recorded.CodeIs(405)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/post_summary/1", server.URL), nil))
+
+	recorded.CodeIs(200)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post_summary", server.URL), map[string]interface{}{"title": "view"}))
+
+	recorded.CodeIs(405)
+	recorded.HeaderIs(AllowHeader, "GET")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/post_summary/1", server.URL), map[string]interface{}{"title": "view"}))
+
+	recorded.CodeIs(405)
+	recorded.HeaderIs(AllowHeader, "GET")
+
+	// unknown names are not cached, so a view created later is read-only
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post_title", server.URL), map[string]interface{}{"title": "view"}))
+
+	recorded.CodeIs(404)
+
+	if _, err := database.Exec("CREATE VIEW post_title AS SELECT id, title FROM Post"); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Exec("DROP VIEW post_title")
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/post_title", server.URL), map[string]interface{}{"title": "view"}))
+
+	recorded.CodeIs(405)
+}
+
+func TestGETQueryShouldReturnRowsOfRegisteredQuery(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/_query/lookups_from?type=PostStatus&code=2&_sortField=code&_sortDir=DESC", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Total-Count", "2")
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprintf("%v", data) != "[map[code:3 name:Archived] map[code:2 name:Published]]" {
+		t.Errorf("The query should have returned the post statuses from code 2, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/_query/lookups_from?type=PostStatus&code=1&_perPage=1&_page=1&_sortField=code&_fields=name", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Total-Count", "3")
+
+	data = []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprintf("%v", data) != "[map[name:Published]]" {
+		t.Errorf("The query should have returned the second page of names, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/_query/lookups_from?type=%%27%%20OR%%20%%271%%27=%%271&code=0", server.URL), nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Total-Count", "0")
+
+	for _, params := range []struct {
+		query string
+		field string
+	}{
+		{"type=PostStatus&code=two", "code"},
+		{"type=PostStatus", "code"},
+		{"type=PostStatus&code=1&name=Draft", "name"},
+	} {
+		recorded = erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/_query/lookups_from?%s", server.URL, params.query), nil))
+
+		recorded.CodeIs(400)
+
+		problem := Problem{}
+		if err := recorded.DecodeJsonPayload(&problem); err != nil {
+			t.Fatal(err)
+		} else if len(problem.Errors) != 1 || problem.Errors[0].Field != params.field {
+			t.Errorf("The parameter %s should have been rejected, got %v", params.field, problem.Errors)
+		}
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/_query/unknown", server.URL), nil))
+
+	recorded.CodeIs(404)
+}
+
+func TestPOSTRpcShouldOnlyCallRegisteredProcedures(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/_rpc/drop_everything", server.URL), []interface{}{}))
+
+	recorded.CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/_rpc/close_month", server.URL), map[string]interface{}{"year": 2016, "month": 1}))
+
+	// SQLite has no stored procedures
+	recorded.CodeIs(501)
+	recorded.HeaderIs("Content-Type", ProblemContentType)
+}
+
+// procedureDriver fakes a MySQL server with stored routines: it answers the
+// parameters of the routines named in params, and records every call, which
+// returns results.
+type procedureDriver struct {
+	params  map[string][][]driver.Value
+	results []procedureResultSet
+	calls   []procedureCall
+}
+
+type procedureCall struct {
+	query string
+	args  []driver.Value
+}
+
+type procedureResultSet struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+var procedures = &procedureDriver{params: map[string][][]driver.Value{
+	"transfer": {{"source", "IN"}, {"target", "IN"}},
+	"balance":  {{"account", "IN"}, {"total", "OUT"}},
+}}
+
+func init() {
+	sql.Register("procedures", procedures)
+}
+
+func (d *procedureDriver) Open(name string) (driver.Conn, error) {
+	return &procedureConn{d}, nil
+}
+
+type procedureConn struct {
+	d *procedureDriver
+}
+
+func (c *procedureConn) Prepare(query string) (driver.Stmt, error) {
+	return &procedureStmt{c.d, query}, nil
+}
+
+func (c *procedureConn) Close() error {
+	return nil
+}
+
+func (c *procedureConn) Begin() (driver.Tx, error) {
+	return procedureTx{}, nil
+}
+
+// procedureTx is a transaction that changes nothing.
+type procedureTx struct{}
+
+func (procedureTx) Commit() error {
+	return nil
+}
+
+func (procedureTx) Rollback() error {
+	return nil
+}
+
+type procedureStmt struct {
+	d     *procedureDriver
+	query string
+}
+
+func (s *procedureStmt) Close() error {
+	return nil
+}
+
+func (s *procedureStmt) NumInput() int {
+	return -1
+}
+
+func (s *procedureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("statements are not supported")
+}
+
+func (s *procedureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.Contains(s.query, "information_schema") {
+		for routine, params := range s.d.params {
+			if strings.Contains(s.query, fmt.Sprintf("'%s'", routine)) {
+				return &procedureRows{sets: []procedureResultSet{{[]string{"parameter_name", "parameter_mode"}, params}}}, nil
+			}
+		}
+		return &procedureRows{sets: []procedureResultSet{{[]string{"parameter_name", "parameter_mode"}, nil}}}, nil
+	}
+
+	s.d.calls = append(s.d.calls, procedureCall{s.query, args})
+	return &procedureRows{sets: s.d.results}, nil
+}
+
+// procedureRows returns its result sets one after the other.
+type procedureRows struct {
+	sets     []procedureResultSet
+	set, row int
+}
+
+func (r *procedureRows) Columns() []string {
+	return r.sets[r.set].columns
+}
+
+func (r *procedureRows) Close() error {
+	return nil
+}
+
+func (r *procedureRows) Next(dest []driver.Value) error {
+	if r.row >= len(r.sets[r.set].rows) {
+		return io.EOF
+	}
+	copy(dest, r.sets[r.set].rows[r.row])
+	r.row++
+	return nil
+}
+
+func (r *procedureRows) HasNextResultSet() bool {
+	return r.set < len(r.sets)-1
+}
+
+func (r *procedureRows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+	r.set, r.row = r.set+1, 0
+	return nil
+}
+
+func TestCallProcedureShouldBindArgumentsAndReturnEveryResultSet(t *testing.T) {
+
+	db, err := sql.Open("procedures", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	em := eram.NewEntityDbManager(db)
+	em.RegisterProcedure("transfer", eram.Procedure{})
+	em.RegisterProcedure("balance", eram.Procedure{})
+	em.RegisterProcedure("close_month", eram.Procedure{Routine: "close_period", Params: []string{"year", "month"}})
+	em.RegisterProcedure("total", eram.Procedure{Kind: eram.StoredFunction, Params: []string{"account"}})
+
+	// two result sets, and the status closing the results of MySQL procedures
+	procedures.results = []procedureResultSet{
+		{[]string{"id", "amount"}, [][]driver.Value{{int64(1), int64(-10)}, {int64(2), int64(10)}}},
+		{[]string{"count"}, [][]driver.Value{{int64(2)}}},
+		{nil, nil},
+	}
+
+	for _, call := range []struct {
+		name  string
+		args  interface{}
+		query string
+		bound string
+	}{
+		{"transfer", map[string]interface{}{"target": 2.0, "source": 1.0}, "CALL transfer(?, ?)", "[1 2]"},
+		{"transfer", []interface{}{1.0, "2"}, "CALL transfer(?, ?)", "[1 2]"},
+		{"transfer", nil, "CALL transfer()", "[]"},
+		{"close_month", map[string]interface{}{"month": 1.0, "year": 2016.0}, "CALL close_period(?, ?)", "[2016 1]"},
+	} {
+		resultSets, err := em.CallProcedure(call.name, call.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := procedures.calls[len(procedures.calls)-1]
+		if last.query != call.query || fmt.Sprintf("%v", last.args) != call.bound {
+			t.Errorf("%s %v should have been bound as %s %s, got %s %v", call.name, call.args, call.query, call.bound, last.query, last.args)
+		} else if fmt.Sprintf("%v", resultSets) != "[[map[amount:-10 id:1] map[amount:10 id:2]] [map[count:2]]]" {
+			t.Errorf("Both result sets of %s should have been returned, got %v", call.name, resultSets)
+		}
+	}
+
+	// a function returns a single result set
+	procedures.results = []procedureResultSet{{[]string{"result"}, [][]driver.Value{{int64(42)}}}}
+
+	resultSets, err := em.CallProcedure("total", []interface{}{7.0})
+	if err != nil {
+		t.Fatal(err)
+	} else if last := procedures.calls[len(procedures.calls)-1]; last.query != "SELECT total(?) AS `result`" {
+		t.Errorf("The function should have been selected, got %s", last.query)
+	} else if fmt.Sprintf("%v", resultSets) != "[[map[result:42]]]" {
+		t.Errorf("The result of the function should have been returned, got %v", resultSets)
+	}
+
+	for _, call := range []struct {
+		name  string
+		args  interface{}
+		field string
+	}{
+		{"transfer", []interface{}{1.0, 2.0, 3.0}, "args"},
+		{"transfer", []interface{}{map[string]interface{}{}}, "args[0]"},
+		{"transfer", map[string]interface{}{"source": 1.0}, "target"},
+		{"transfer", map[string]interface{}{"source": 1.0, "target": 2.0, "memo": "rent"}, "memo"},
+		{"transfer", "1, 2", "args"},
+	} {
+		calls := len(procedures.calls)
+
+		var queryErr *eram.QueryError
+		if _, err := em.CallProcedure(call.name, call.args); !errors.As(err, &queryErr) || queryErr.Param != call.field {
+			t.Errorf("%v should have been rejected on %s, got %v", call.args, call.field, err)
+		} else if len(procedures.calls) != calls {
+			t.Errorf("%v should not have been called", call.args)
+		}
+	}
+
+	// the output of OUT parameters cannot be returned
+	_, err = em.CallProcedure("balance", []interface{}{1.0})
+	if problem := NewEntityRestAPI(em).problemFor("balance", err); problem.Status != 501 {
+		t.Errorf("Routines with OUT parameters should not be supported, got %v", problem)
+	}
+}
+
+func TestFiltersShouldEscapeQuotesAndBackslashes(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/tag", server.URL), map[string]string{"name": `it's \ quoted`}))
+
+	recorded.CodeIs(201)
+
+	for _, filter := range []string{"name", "name__exact"} {
+		recorded = erat.RunRequest(
+			t,
+			handler,
+			erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag?%s=%s", server.URL, filter, url.QueryEscape(`it's \ quoted`)), nil))
+
+		recorded.CodeIs(200)
+
+		list := []map[string]interface{}{}
+		if err := recorded.DecodeJsonPayload(&list); err != nil {
+			t.Fatal(err)
+		} else if len(list) != 1 {
+			t.Errorf("%s should have matched the quoted tag, got %v", filter, list)
+		}
+	}
+
+	// MySQL reads backslashes in string literals as escapes
+	db, err := sql.Open("procedures", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	em := eram.NewEntityDbManager(db)
+	procedures.results = []procedureResultSet{{[]string{"count"}, [][]driver.Value{{int64(0)}}}}
+
+	for _, filter := range []string{"name", "name__exact"} {
+		calls := len(procedures.calls)
+
+		if _, _, err := em.ListEntities("tag", eram.Query{Filters: map[string]string{filter: `\' OR 1=1 -- `}, Limit: 10}); err != nil {
+			t.Fatal(err)
+		} else if len(procedures.calls) == calls {
+			t.Fatalf("%s should have been queried", filter)
+		}
+
+		for _, call := range procedures.calls[calls:] {
+			if !strings.Contains(call.query, `'\\'' OR 1=1 -- '`) {
+				t.Errorf("%s should have been escaped for MySQL, got %s", filter, call.query)
+			}
+		}
+	}
+}
+
+func TestListEntitiesShouldUsePostgresSyntaxForSearches(t *testing.T) {
+
+	db, err := sql.Open("procedures", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	em := eram.NewEntityDbManager(db)
+	em.Dialect = eram.Postgres
+	em.SetSearchIndex("post", eram.SearchIndex{Columns: []string{"title", "content"}, Index: "search_vector"})
+	procedures.results = []procedureResultSet{{[]string{"count"}, [][]driver.Value{{int64(0)}}}}
+
+	calls := len(procedures.calls)
+
+	if _, _, err := em.ListEntities("post", eram.Query{
+		SortField: eram.ScoreField,
+		Limit:     10,
+		Offset:    20,
+		Options:   []eram.ReadOption{eram.Search("zebra")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := procedures.calls[calls:]
+	if len(queries) != 2 {
+		t.Fatalf("The posts and their count should have been queried, got %v", queries)
+	}
+
+	expected := `SELECT * FROM "post" WHERE "post"."search_vector" @@ plainto_tsquery('zebra') ` +
+		`ORDER BY ts_rank("post"."search_vector", plainto_tsquery('zebra')) ASC LIMIT 10 OFFSET 20`
+	if queries[0].query != expected {
+		t.Errorf("The search should have been written for Postgres, got %s", queries[0].query)
+	} else if strings.Contains(queries[1].query, "`") {
+		t.Errorf("The count should have been written for Postgres, got %s", queries[1].query)
+	}
+}
+
+func TestRunQueryShouldUsePostgresSyntax(t *testing.T) {
+
+	db, err := sql.Open("procedures", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	em := eram.NewEntityDbManager(db)
+	em.Dialect = eram.Postgres
+	em.RegisterQuery("recent_posts", "SELECT id, title FROM post WHERE status = :status", eram.QueryParam{Name: "status", Type: eram.IntegerParam})
+	procedures.results = []procedureResultSet{{[]string{"count"}, [][]driver.Value{{int64(0)}}}}
+
+	calls := len(procedures.calls)
+
+	if _, _, err := em.RunQuery("recent_posts", eram.Query{
+		Filters:   map[string]string{"status": "2"},
+		SortField: "title",
+		Limit:     10,
+		Offset:    20,
+		Options:   []eram.ReadOption{eram.Fields("id", "title")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `SELECT "id", "title" FROM (SELECT id, title FROM post WHERE status = $1) AS q ORDER BY "title" ASC LIMIT 10 OFFSET 20`
+	if queries := procedures.calls[calls:]; len(queries) == 0 || queries[0].query != expected {
+		t.Errorf("The query should have been written for Postgres, got %v", queries)
+	}
+}
+
+func TestIfMatchShouldLockTheRowUntilItIsWritten(t *testing.T) {
+
+	db, err := sql.Open("procedures", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	em := eram.NewEntityDbManager(db)
+	procedures.results = []procedureResultSet{{[]string{"id", "name"}, [][]driver.Value{{int64(1), "news"}}}}
+
+	_, _, updateErr := em.UpdateEntityIfMatch("tag", "1", map[string]interface{}{"name": "stale"}, `"stale"`)
+	updateQuery := procedures.calls[len(procedures.calls)-1].query
+
+	_, deleteErr := em.DeleteEntityIfMatch("tag", "1", `"stale"`)
+	deleteQuery := procedures.calls[len(procedures.calls)-1].query
+
+	for _, read := range []struct {
+		err   error
+		query string
+	}{{updateErr, updateQuery}, {deleteErr, deleteQuery}} {
+		if !errors.Is(read.err, eram.ErrPreconditionFailed) {
+			t.Errorf("The stale If-Match should have failed, got %v", read.err)
+		} else if !strings.HasSuffix(read.query, " FOR UPDATE") {
+			t.Errorf("The row should have been locked while checked, got %s", read.query)
+		}
+	}
+}
+
+// stubManager serves fixed rows, and implements none of the optional
+// interfaces of the manager package.
+type stubManager struct {
+	rows []map[string]interface{}
+}
+
+func (m *stubManager) GetIdColumn(entity string) string {
+	return "id"
+}
+
+func (m *stubManager) ListEntities(entity string, query eram.Query) ([]map[string]interface{}, int, error) {
+	if query.Offset >= len(m.rows) {
+		return []map[string]interface{}{}, len(m.rows), nil
+	} else if end := query.Offset + query.Limit; end < len(m.rows) {
+		return m.rows[query.Offset:end], len(m.rows), nil
+	}
+	return m.rows[query.Offset:], len(m.rows), nil
+}
+
+func (m *stubManager) GetEntity(entity string, id string, opts ...eram.ReadOption) (map[string]interface{}, error) {
+	for _, row := range m.rows {
+		if fmt.Sprintf("%v", row["id"]) == id {
+			return row, nil
+		}
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (m *stubManager) PostEntity(entity string, postData map[string]interface{}) (int64, error) {
+	return 0, fmt.Errorf("read-only")
+}
+
+func (m *stubManager) UpdateEntityIfMatch(entity string, id string, updateData map[string]interface{}, ifMatch string) (int64, map[string]interface{}, error) {
+	return 0, nil, fmt.Errorf("read-only")
+}
+
+func (m *stubManager) DeleteEntityIfMatch(entity string, id string, ifMatch string) (int64, error) {
+	return 0, fmt.Errorf("read-only")
+}
+
+func (m *stubManager) EntityTag(entity string, row map[string]interface{}) string {
+	return eram.HashEntityTag(row)
+}
+
+func (m *stubManager) LastModified(entity string, rows ...map[string]interface{}) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (m *stubManager) ClassifyError(err error) error {
+	return err
+}
+
+func (m *stubManager) InTransaction(fn func(eram.EntityManager) error) error {
+	return fn(m)
+}
+
+func TestProblemsShouldMapWrappedErrorsAndLogUnexpectedOnes(t *testing.T) {
+
+	var logged bytes.Buffer
+	problemApi := NewEntityRestAPI(entityManager)
+	problemApi.SetLogger(log.New(&logged, "", 0))
+
+	for _, expected := range []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("reading: %w", &eram.QueryError{Param: "_sort", Message: "is unknown"}), 400},
+		{fmt.Errorf("deleting: %w", &eram.RestrictError{Id: "1"}), 409},
+		{fmt.Errorf("writing: %w", &eram.ValidationError{Fields: []eram.FieldError{{Field: "title", Message: "is required"}}}), 422},
+		{fmt.Errorf("writing: %w", &eram.DbError{Kind: eram.UniqueViolation, Field: "name", Err: errors.New("duplicate")}), 409},
+		{fmt.Errorf("updating: %w", eram.ErrPreconditionFailed), 412},
+		{errors.New("disk on fire"), 500},
+	} {
+		if problem := problemApi.problemFor("post", expected.err); problem.Status != expected.status {
+			t.Errorf("%v should have been a %d problem, got %v", expected.err, expected.status, problem)
+		}
+	}
+
+	if !strings.Contains(logged.String(), "disk on fire") || strings.Contains(logged.String(), "duplicate") {
+		t.Errorf("Only the unexpected error should have been logged, got %q", logged.String())
+	}
+}
+
+func TestAPIShouldServeAnyEntityManager(t *testing.T) {
+
+	stubApi := rest.NewApi()
+	stubRestApi := NewEntityRestAPI(&stubManager{rows: []map[string]interface{}{
+		{"id": 1, "name": "first"},
+		{"id": 2, "name": "second"},
+	}})
+
+	router, err := rest.MakeRouter(
+		rest.Get("/api/:entity", stubRestApi.GetAllEntities),
+		rest.Get("/api/:entity/_aggregate", stubRestApi.AggregateEntities),
+		rest.Get("/api/:entity/:id", stubRestApi.GetEntity),
+		rest.Post("/api/:entity/:id/_restore", stubRestApi.RestoreEntity),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stubApi.SetApp(router)
+	stubHandler := stubApi.MakeHandler()
+
+	recorded := erat.RunRequest(
+		t,
+		stubHandler,
+		erat.MakeSimpleRequest("GET", "http://localhost/api/item?_perPage=1&_page=1", nil))
+
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Total-Count", "2")
+
+	data := []map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&data); err != nil {
+		t.Fatal(err)
+	} else if len(data) != 1 || data[0]["name"] != "second" {
+		t.Errorf("The second page should have been returned, got %v", data)
+	}
+
+	recorded = erat.RunRequest(
+		t,
+		stubHandler,
+		erat.MakeSimpleRequest("GET", "http://localhost/api/item?_perPage=many", nil))
+
+	recorded.CodeIs(400)
+
+	recorded = erat.RunRequest(
+		t,
+		stubHandler,
+		erat.MakeSimpleRequest("GET", "http://localhost/api/item/1", nil))
+
+	recorded.CodeIs(200)
+
+	for _, request := range []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/api/item/_aggregate?groupBy=name"},
+		{"POST", "/api/item/1/_restore"},
+	} {
+		recorded = erat.RunRequest(
+			t,
+			stubHandler,
+			erat.MakeSimpleRequest(request.method, "http://localhost"+request.path, nil))
+
+		recorded.CodeIs(501)
+	}
+}
+
+// newMemoryHandler serves a memory manager loaded with books.
+func newMemoryHandler(t *testing.T) (*eram.MemoryEntityManager, http.Handler) {
+	fixtures, err := ioutil.TempFile("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fixtures.Name())
+
+	fixtures.WriteString(`{"book": [
+		{"id": 1, "title": "Dune", "year": 1965, "available": true},
+		{"id": 2, "title": "Emma", "year": 1815, "available": false},
+		{"id": 3, "title": "Dracula", "year": 1897, "available": true},
+		{"title": "Mémoires", "year": 1849, "available": true}
+	]}`)
+	fixtures.Close()
+
+	memoryManager := eram.NewMemoryEntityManager()
+	memoryManager.SetFoldAccents(true)
+	if err := memoryManager.LoadFixtures(fixtures.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	memoryApi := rest.NewApi()
+	memoryRestApi := NewEntityRestAPI(memoryManager)
+
+	router, err := rest.MakeRouter(
+		rest.Post("/api/_batch", memoryRestApi.PostBatch),
+		rest.Get("/api/:entity", memoryRestApi.GetAllEntities),
+		rest.Post("/api/:entity", memoryRestApi.PostEntity),
+		rest.Get("/api/:entity/:id", memoryRestApi.GetEntity),
+		rest.Put("/api/:entity/:id", memoryRestApi.PutEntity),
+		rest.Delete("/api/:entity/:id", memoryRestApi.DeleteEntity),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memoryApi.SetApp(router)
+	return memoryManager, memoryApi.MakeHandler()
+}
+
+func TestMemoryManagerShouldServeTheSameListsAsTheDatabase(t *testing.T) {
+	_, memoryHandler := newMemoryHandler(t)
+
+	for _, list := range []struct {
+		query  string
+		titles string
+		count  string
+	}{
+		{"title=d*&_sortField=year&_sortDir=DESC", "[Dune Dracula]", "2"},
+		{"available=1&_perPage=2&_page=1", "[Dracula Mémoires]", "3"},
+		{"title__icontains=MEMO", "[Mémoires]", "1"},
+		{"title__contains=memo", "[]", "0"},
+		{"title__like=D*a", "[Dracula]", "1"},
+		{"_sort=title", "[Dracula Dune Emma Mémoires]", "4"},
+	} {
+		recorded := erat.RunRequest(
+			t,
+			memoryHandler,
+			erat.MakeSimpleRequest("GET", "http://localhost/api/book?"+list.query, nil))
+
+		recorded.CodeIs(200)
+		recorded.HeaderIs("X-Total-Count", list.count)
+
+		data := []map[string]interface{}{}
+		if err := recorded.DecodeJsonPayload(&data); err != nil {
+			t.Fatal(err)
+		}
+
+		var titles []interface{}
+		for _, book := range data {
+			titles = append(titles, book["title"])
+		}
+
+		if fmt.Sprintf("%v", titles) != list.titles {
+			t.Errorf("%s should have listed %s, got %v", list.query, list.titles, titles)
+		}
+	}
+
+	recorded := erat.RunRequest(
+		t,
+		memoryHandler,
+		erat.MakeSimpleRequest("GET", "http://localhost/api/magazine", nil))
+
+	recorded.CodeIs(404)
+
+	for _, query := range []string{"author=Stoker", "title__icontains=d&publisher__exact=x", "_sort=author"} {
+		recorded = erat.RunRequest(
+			t,
+			memoryHandler,
+			erat.MakeSimpleRequest("GET", "http://localhost/api/book?"+query, nil))
+
+		recorded.CodeIs(400)
+	}
+}
+
+func TestMemoryManagerShouldNotSupportRelationships(t *testing.T) {
+	memoryManager, _ := newMemoryHandler(t)
+
+	related := eram.RelatedTo(eram.Relationship{Name: "authors", Kind: eram.ManyToMany}, 1)
+	_, _, err := memoryManager.ListEntities("book", eram.Query{Limit: 10, Options: []eram.ReadOption{related}})
+
+	if problem := NewEntityRestAPI(memoryManager).problemFor("book", err); problem.Status != 501 {
+		t.Errorf("Relationships should not be implemented in memory, got %v", problem)
+	}
+}
+
+func TestMemoryManagerShouldWriteEntitiesAndRollBackBatches(t *testing.T) {
+	memoryManager, memoryHandler := newMemoryHandler(t)
+
+	recorded := erat.RunRequest(
+		t,
+		memoryHandler,
+		erat.MakeSimpleRequest("POST", "http://localhost/api/book", map[string]interface{}{"title": "Ulysses", "year": 1922}))
+
+	recorded.CodeIs(201)
+	recorded.HeaderIs(EntityIDHeader, "5")
+
+	recorded = erat.RunRequest(
+		t,
+		memoryHandler,
+		erat.MakeSimpleRequest("GET", "http://localhost/api/book/5", nil))
+
+	recorded.CodeIs(200)
+	etag := recorded.Recorder.Header().Get(ETagHeader)
+
+	request := erat.MakeSimpleRequest("PUT", "http://localhost/api/book/5", map[string]interface{}{"year": 1920})
+	request.Header.Set(IfMatchHeader, `"stale"`)
+	erat.RunRequest(t, memoryHandler, request).CodeIs(412)
+
+	request = erat.MakeSimpleRequest("PUT", "http://localhost/api/book/5", map[string]interface{}{"year": 1920})
+	request.Header.Set(IfMatchHeader, etag)
+	erat.RunRequest(t, memoryHandler, request).CodeIs(200)
+
+	erat.RunRequest(
+		t,
+		memoryHandler,
+		erat.MakeSimpleRequest("DELETE", "http://localhost/api/book/2", nil)).CodeIs(200)
+
+	erat.RunRequest(
+		t,
+		memoryHandler,
+		erat.MakeSimpleRequest("GET", "http://localhost/api/book/2", nil)).CodeIs(404)
+
+	recorded = erat.RunRequest(
+		t,
+		memoryHandler,
+		erat.MakeSimpleRequest("POST", "http://localhost/api/_batch", []BatchOperation{
+			{Method: BatchCreate, Entity: "book", Data: map[string]interface{}{"title": "Middlemarch"}},
+			{Method: BatchDelete, Entity: "book", Id: 1},
+			{Method: BatchUpdate, Entity: "book", Id: 2, Data: map[string]interface{}{"year": 1816}},
+		}))
+
+	recorded.CodeIs(404)
+
+	books, count, err := memoryManager.ListEntities("book", eram.Query{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 4 || books[0]["title"] != "Dune" {
+		t.Errorf("The failed batch should have been rolled back, got %v", books)
+	}
+}
+
+func TestMemoryManagerShouldAnswerUnchangedUpdatesAsTheDatabase(t *testing.T) {
+	_, memoryHandler := newMemoryHandler(t)
+
+	for _, backend := range []struct {
+		handler http.Handler
+		url     string
+		field   string
+	}{
+		{handler, fmt.Sprintf("%s/api/tag/1", server.URL), "name"},
+		{memoryHandler, "http://localhost/api/book/1", "title"},
+	} {
+		recorded := erat.RunRequest(t, backend.handler, erat.MakeSimpleRequest("GET", backend.url, nil))
+		recorded.CodeIs(200)
+
+		data := map[string]interface{}{}
+		if err := recorded.DecodeJsonPayload(&data); err != nil {
+			t.Fatal(err)
+		}
+
+		recorded = erat.RunRequest(
+			t,
+			backend.handler,
+			erat.MakeSimpleRequest("PUT", backend.url, map[string]interface{}{backend.field: data[backend.field]}))
+
+		recorded.CodeIs(200)
+	}
+}
+
+func TestMemoryManagerShouldKeepWritesMadeDuringFailedTransactions(t *testing.T) {
+	memoryManager, _ := newMemoryHandler(t)
+
+	updated, release := make(chan bool), make(chan bool)
+	failed := make(chan error)
+	go func() {
+		failed <- memoryManager.InTransaction(func(txm eram.EntityManager) error {
+			txm.UpdateEntityIfMatch("book", "1", map[string]interface{}{"title": "Children of Dune"}, "")
+			updated <- true
+			<-release
+			return errors.New("rollback")
+		})
+	}()
+
+	<-updated
+	written := make(chan error)
+	go func() {
+		_, _, err := memoryManager.UpdateEntityIfMatch("book", "1", map[string]interface{}{"year": 1966}, "")
+		written <- err
+	}()
+
+	// gives the concurrent write the time to run before the rollback
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if err := <-failed; err == nil {
+		t.Fatal("The transaction should have failed")
+	} else if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := memoryManager.GetEntity("book", "1")
+	if err != nil {
+		t.Fatal(err)
+	} else if book["title"] != "Dune" || book["year"] != 1966 {
+		t.Errorf("The rollback should have kept the concurrent write only, got %v", book)
+	}
+}
+
+func TestMemoryManagerShouldSaveFixturesAndAssignUniqueIds(t *testing.T) {
+	memoryManager, _ := newMemoryHandler(t)
+
+	var wg sync.WaitGroup
+	ids := make(chan int64, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if id, err := memoryManager.PostEntity("book", map[string]interface{}{"title": fmt.Sprintf("Volume %d", i)}); err == nil {
+				ids <- id
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	unique := map[int64]bool{}
+	for id := range ids {
+		unique[id] = true
+	}
+
+	if len(unique) != 20 {
+		t.Errorf("Every book should have got its own id, got %v", unique)
+	}
+
+	fixtures, err := ioutil.TempFile("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures.Close()
+	defer os.Remove(fixtures.Name())
+
+	if err := memoryManager.SaveFixtures(fixtures.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := eram.NewMemoryEntityManager()
+	if err := loaded.LoadFixtures(fixtures.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _, _ := memoryManager.ListEntities("book", eram.Query{Limit: 100})
+	books, count, err := loaded.ListEntities("book", eram.Query{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 24 || fmt.Sprintf("%v", books) != fmt.Sprintf("%v", saved) {
+		t.Errorf("The saved books should have been loaded, got %v", books)
+	}
+}
+
+func TestIfMatchShouldAcceptTheETagOfRowsModifiedByAfterReadHooks(t *testing.T) {
+
+	recorded := erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("POST", fmt.Sprintf("%s/api/tag", server.URL), map[string]string{"name": "secret-plan"}))
+
+	recorded.CodeIs(201)
+	id := recorded.Recorder.Header().Get(EntityIDHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag/%s", server.URL, id), nil))
+
+	recorded.CodeIs(200)
+	etag := recorded.Recorder.Header().Get(ETagHeader)
+
+	request := erat.MakeSimpleRequest("PUT", fmt.Sprintf("%s/api/tag/%s", server.URL, id), map[string]interface{}{"frequency": 5})
+	request.Header.Set(IfMatchHeader, etag)
+	recorded = erat.RunRequest(t, handler, request)
+
+	recorded.CodeIs(200)
+
+	updated := map[string]interface{}{}
+	if err := recorded.DecodeJsonPayload(&updated); err != nil {
+		t.Fatal(err)
+	} else if updated["name"] != "[redacted]" {
+		t.Errorf("The updated tag should have been returned as GET returns it, got %v", updated)
+	}
+
+	etag = recorded.Recorder.Header().Get(ETagHeader)
+
+	recorded = erat.RunRequest(
+		t,
+		handler,
+		erat.MakeSimpleRequest("GET", fmt.Sprintf("%s/api/tag/%s", server.URL, id), nil))
+
+	recorded.HeaderIs(ETagHeader, etag)
+
+	request = erat.MakeSimpleRequest("DELETE", fmt.Sprintf("%s/api/tag/%s", server.URL, id), nil)
+	request.Header.Set(IfMatchHeader, etag)
+	erat.RunRequest(t, handler, request).CodeIs(200)
+}
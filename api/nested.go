@@ -0,0 +1,243 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// GetAllChildren lists the children of an entity, e.g. the comments of a post
+// with GET /api/post/1/comment, or the tags linked to it through a join table
+// with GET /api/post/1/tag, with the same filters, sort and pagination as
+// GetAllEntities.
+func (api *EntityRestAPI) GetAllChildren(w rest.ResponseWriter, r *rest.Request) {
+	rel, value, ok := api.childRelationship(w, r)
+	if !ok || !api.checkChildOperation(w, rel, List) {
+		return
+	}
+
+	api.getEntities(w, r, rel.Target, eram.RelatedTo(rel, value))
+}
+
+// GetChild returns a child of an entity, which is not found when it belongs
+// to another parent.
+func (api *EntityRestAPI) GetChild(w rest.ResponseWriter, r *rest.Request) {
+	rel, value, ok := api.childRelationship(w, r)
+	if !ok || !api.checkChildOperation(w, rel, Read) {
+		return
+	}
+
+	api.getEntity(w, r, rel.Target, r.PathParam("childId"), eram.RelatedTo(rel, value))
+}
+
+// PostChild creates a child of an entity, referencing it whatever the payload.
+// Through a join table, it links the existing entity whose id is sent instead.
+func (api *EntityRestAPI) PostChild(w rest.ResponseWriter, r *rest.Request) {
+	rel, value, ok := api.childRelationship(w, r)
+	if !ok || !api.checkChildOperation(w, rel, Create) {
+		return
+	} else if rel.Kind == eram.OneToMany {
+		api.postEntity(w, r, rel.Target, map[string]interface{}{rel.TargetColumn(): value})
+		return
+	}
+
+	target := map[string]interface{}{}
+	if err := r.DecodeJsonPayload(&target); err != nil {
+		writeProblem(w, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	targetId, ok := target[rel.TargetColumn()]
+	if !ok {
+		writeProblem(w, NewProblem(http.StatusUnprocessableEntity, "The entity to link is missing.").
+			withField(rel.TargetColumn(), "is required"))
+		return
+	}
+
+	linked, err := api.em.(eram.Relater).Link(r.PathParam("entity"), r.PathParam("id"), rel.Name, targetId)
+	if err != nil {
+		api.writeError(w, rel.Target, err)
+		return
+	}
+
+	linkedEntity, err := api.em.GetEntity(rel.Target, fmt.Sprintf("%v", targetId))
+	if err != nil {
+		api.writeError(w, rel.Target, err)
+		return
+	}
+
+	if linked > 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.WriteJson(linkedEntity)
+}
+
+// PutAllChildren replaces the entities linked to an entity through a join
+// table by the ones whose ids are sent, e.g. PUT /api/post/1/tag with [1, 2].
+func (api *EntityRestAPI) PutAllChildren(w rest.ResponseWriter, r *rest.Request) {
+	rel, value, ok := api.childRelationship(w, r)
+	if !ok {
+		return
+	} else if rel.Kind != eram.ManyToMany {
+		api.allowChildMethods(w, rel, collectionMethods)
+		writeProblem(w, NewProblem(http.StatusMethodNotAllowed, fmt.Sprintf("The children '%s' are not linked through a join table.", rel.Name)))
+		return
+	} else if !api.checkChildOperation(w, rel, Update) {
+		return
+	}
+
+	targetIds := []interface{}{}
+	if err := r.DecodeJsonPayload(&targetIds); err != nil {
+		writeProblem(w, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if err := api.em.(eram.Relater).SetLinks(r.PathParam("entity"), r.PathParam("id"), rel.Name, targetIds...); err != nil {
+		api.writeError(w, rel.Target, err)
+		return
+	}
+
+	api.getEntities(w, r, rel.Target, eram.RelatedTo(rel, value))
+}
+
+// linkMethods are the methods of the operations on an entity linked through a
+// join table, e.g. /api/post/1/tag/1, which is updated through its own route.
+var linkMethods = []methodOperation{
+	{http.MethodGet, Read},
+	{http.MethodDelete, Delete},
+}
+
+// PutChild updates a child of an entity. It cannot be moved to another parent.
+func (api *EntityRestAPI) PutChild(w rest.ResponseWriter, r *rest.Request) {
+	rel, value, ok := api.childRelationship(w, r)
+	if !ok {
+		return
+	} else if rel.Kind != eram.OneToMany {
+		api.allowChildMethods(w, rel, linkMethods)
+		writeProblem(w, NewProblem(http.StatusMethodNotAllowed, fmt.Sprintf("Linked entities are updated through /%s/%s.", rel.Target, r.PathParam("childId"))))
+		return
+	} else if !api.checkChildOperation(w, rel, Update) {
+		return
+	}
+
+	api.updateEntity(w, r, rel.Target, r.PathParam("childId"), map[string]interface{}{rel.TargetColumn(): value})
+}
+
+// PatchChild behaves like PutChild.
+func (api *EntityRestAPI) PatchChild(w rest.ResponseWriter, r *rest.Request) {
+	api.PutChild(w, r)
+}
+
+// DeleteChild deletes a child of an entity, which is not found when it
+// belongs to another parent. Through a join table, it only unlinks it.
+func (api *EntityRestAPI) DeleteChild(w rest.ResponseWriter, r *rest.Request) {
+	rel, value, ok := api.childRelationship(w, r)
+	if !ok || !api.checkChildOperation(w, rel, Delete) {
+		return
+	}
+
+	childId := r.PathParam("childId")
+	if rel.Kind == eram.OneToMany {
+		api.deleteEntity(w, r, rel.Target, childId, map[string]interface{}{rel.TargetColumn(): value})
+		return
+	}
+
+	unlinked, err := api.em.(eram.Relater).Unlink(r.PathParam("entity"), r.PathParam("id"), rel.Name, childId)
+	if err != nil {
+		api.writeError(w, rel.Target, err)
+	} else if unlinked == 0 {
+		writeProblem(w, notFound(rel.Target, childId))
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// childRelationship resolves the one-to-many or many-to-many relationship
+// named by the child path parameter, and returns it with the value of the
+// parent its children are related to. A problem is written when either the
+// relationship or the parent does not exist.
+func (api *EntityRestAPI) childRelationship(w rest.ResponseWriter, r *rest.Request) (eram.Relationship, interface{}, bool) {
+	id := r.PathParam("id")
+	entity := r.PathParam("entity")
+	name := r.PathParam("child")
+
+	relater, ok := api.em.(eram.Relater)
+	if !ok {
+		writeProblem(w, notImplemented("relationships"))
+		return eram.Relationship{}, nil, false
+	}
+
+	rel, err := relater.Relationship(entity, name)
+	if _, unknown := err.(*eram.QueryError); unknown || (err == nil && rel.Kind == eram.ManyToOne) {
+		writeProblem(w, NewProblem(http.StatusNotFound, fmt.Sprintf("Entity '%s' has no children '%s'.", entity, name)))
+		return rel, nil, false
+	} else if err != nil {
+		api.writeError(w, entity, err)
+		return rel, nil, false
+	}
+
+	parent, err := api.em.GetEntity(entity, id)
+	if err != nil {
+		api.writeError(w, entity, err)
+		return rel, nil, false
+	} else if len(parent) <= 0 {
+		writeProblem(w, notFound(entity, id))
+		return rel, nil, false
+	}
+
+	return rel, parent[rel.LocalColumn()], true
+}
+
+// checkChildOperation checks that an operation on the children of rel is
+// allowed.
+func (api *EntityRestAPI) checkChildOperation(w rest.ResponseWriter, rel eram.Relationship, operation Operation) bool {
+	entity, operation := childOperation(rel, operation)
+	return api.checkOperation(w, entity, operation)
+}
+
+// childOperation returns the entity and operation an operation on the children
+// of rel is checked against. Linking and unlinking entities through a join
+// table updates the parent, while the other operations apply to the children.
+func childOperation(rel eram.Relationship, operation Operation) (string, Operation) {
+	if rel.Kind == eram.ManyToMany && operation != List && operation != Read {
+		return rel.Entity, Update
+	}
+	return rel.Target, operation
+}
+
+// allowChildMethods sets the Allow header of a 405 Method Not Allowed response
+// on a route of the children of rel to the methods of routeMethods allowed on
+// them.
+func (api *EntityRestAPI) allowChildMethods(w rest.ResponseWriter, rel eram.Relationship, routeMethods []methodOperation) {
+	var methods []string
+	for _, m := range routeMethods {
+		entity, operation := childOperation(rel, m.operation)
+		if api.allows(api.em, entity, operation) {
+			methods = append(methods, m.method)
+		}
+	}
+
+	w.Header().Set(AllowHeader, strings.Join(methods, ", "))
+}
+
+// hasFields reports whether the entity with the given id exists and has the
+// given field values.
+func hasFields(em eram.EntityManager, entity string, id string, fields map[string]interface{}) (bool, error) {
+	if len(fields) == 0 {
+		return true, nil
+	}
+
+	row, err := em.GetEntity(entity, id, whereFields(fields)...)
+	return len(row) > 0, err
+}
+
+func whereFields(fields map[string]interface{}) []eram.ReadOption {
+	var options []eram.ReadOption
+	for field, value := range fields {
+		options = append(options, eram.Where(field, value))
+	}
+	return options
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+const AllowHeader = "Allow"
+
+// Operation is a kind of request an entity may accept.
+type Operation string
+
+const (
+	List   Operation = "list"
+	Read   Operation = "read"
+	Create Operation = "create"
+	Update Operation = "update"
+	Delete Operation = "delete"
+	// Bulk allows the create, update and delete operations of an entity in
+	// a batch, provided they are allowed as well.
+	Bulk Operation = "bulk"
+)
+
+// ReadOnly are the operations of an entity that cannot be modified, which is
+// the default for SQL views.
+var ReadOnly = []Operation{List, Read}
+
+// methodOperation is the operation of a method on a route.
+type methodOperation struct {
+	method    string
+	operation Operation
+}
+
+// collectionMethods and itemMethods are the methods of the operations on
+// /api/:entity and /api/:entity/:id, in the order of the Allow header.
+var (
+	collectionMethods = []methodOperation{
+		{http.MethodGet, List},
+		{http.MethodPost, Create},
+	}
+	itemMethods = []methodOperation{
+		{http.MethodGet, Read},
+		{http.MethodPut, Update},
+		{http.MethodPatch, Update},
+		{http.MethodDelete, Delete},
+	}
+)
+
+// SetOperations restricts the operations entity accepts to operations. The
+// others are rejected with 405 Method Not Allowed. Entities accept every
+// operation by default, except views which are read-only.
+func (api *EntityRestAPI) SetOperations(entity string, operations ...Operation) {
+	api.operations[entity] = operations
+}
+
+// allows reports whether entity accepts operation, reading whether it is a
+// view through em.
+func (api *EntityRestAPI) allows(em eram.EntityManager, entity string, operation Operation) bool {
+	operations, ok := api.operations[entity]
+	if !ok {
+		views, ok := em.(eram.ViewReporter)
+		if !ok {
+			return true
+		} else if view, err := views.IsView(entity); err != nil || !view {
+			return true
+		}
+		operations = ReadOnly
+	}
+
+	for _, allowed := range operations {
+		if allowed == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOperation writes a 405 Method Not Allowed response, with the methods
+// entity accepts on the same route, and returns false if entity does not
+// accept operation.
+func (api *EntityRestAPI) checkOperation(w rest.ResponseWriter, entity string, operation Operation) bool {
+	if api.allows(api.em, entity, operation) {
+		return true
+	}
+
+	routeMethods := collectionMethods
+	if operation != List && operation != Create {
+		routeMethods = itemMethods
+	}
+
+	var methods []string
+	for _, m := range routeMethods {
+		if api.allows(api.em, entity, m.operation) {
+			methods = append(methods, m.method)
+		}
+	}
+
+	w.Header().Set(AllowHeader, strings.Join(methods, ", "))
+	writeProblem(w, NewProblem(http.StatusMethodNotAllowed, fmt.Sprintf("Entity '%s' does not allow the %s operation.", entity, operation)))
+	return false
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object, extended with the list of
+// fields responsible for the problem.
+type Problem struct {
+	Type   string         `json:"type"`
+	Title  string         `json:"title"`
+	Status int            `json:"status"`
+	Detail string         `json:"detail,omitempty"`
+	Errors []FieldProblem `json:"errors,omitempty"`
+}
+
+// FieldProblem describes what is wrong with a single field.
+type FieldProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// NewProblem returns a problem titled after its HTTP status.
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) withField(field string, message string) *Problem {
+	if field != "" {
+		p.Errors = append(p.Errors, FieldProblem{field, message})
+	}
+	return p
+}
+
+// writeProblem writes p as an application/problem+json response.
+func writeProblem(w rest.ResponseWriter, p *Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	w.WriteJson(p)
+}
+
+// writeError writes the problem matching an error returned by the manager.
+func (api *EntityRestAPI) writeError(w rest.ResponseWriter, entity string, err error) {
+	writeProblem(w, api.problemFor(entity, err))
+}
+
+// problemFor maps an error returned by the manager to a problem. Database
+// messages are never exposed, since they leak SQL details.
+func (api *EntityRestAPI) problemFor(entity string, err error) *Problem {
+	err = api.em.ClassifyError(err)
+
+	switch {
+	case errors.Is(err, eram.ErrPreconditionFailed):
+		return NewProblem(http.StatusPreconditionFailed, "The entity was modified since it was last read.")
+	case errors.Is(err, eram.ErrSoftDeleteNotConfigured):
+		return NewProblem(http.StatusBadRequest, fmt.Sprintf("Entity '%s' cannot be restored.", entity))
+	case errors.Is(err, eram.ErrUnknownQuery):
+		return NewProblem(http.StatusNotFound, fmt.Sprintf("Query '%s' does not exist.", entity))
+	case errors.Is(err, eram.ErrUnknownProcedure):
+		return NewProblem(http.StatusNotFound, fmt.Sprintf("Procedure '%s' does not exist.", entity))
+	case errors.Is(err, eram.ErrProceduresNotSupported):
+		return NewProblem(http.StatusNotImplemented, "The database does not support stored procedures.")
+	}
+
+	var hookErr *eram.HookError
+	if errors.As(err, &hookErr) {
+		return NewProblem(hookErr.HTTPStatus(), hookErr.Message)
+	}
+
+	var notSupportedErr *eram.NotSupportedError
+	if errors.As(err, &notSupportedErr) {
+		return notImplemented(notSupportedErr.Feature)
+	}
+
+	var queryErr *eram.QueryError
+	if errors.As(err, &queryErr) {
+		return NewProblem(http.StatusBadRequest, "The query is invalid.").
+			withField(queryErr.Param, queryErr.Message)
+	}
+
+	var restrictErr *eram.RestrictError
+	if errors.As(err, &restrictErr) {
+		p := NewProblem(http.StatusConflict, fmt.Sprintf("Entity '%s' with id '%s' still has children.", entity, restrictErr.Id))
+		for _, children := range restrictErr.Children {
+			p.withField(children.Relationship, fmt.Sprintf("%s %v", children.Entity, children.Ids))
+		}
+		return p
+	}
+
+	var validationErr *eram.ValidationError
+	if errors.As(err, &validationErr) {
+		p := NewProblem(http.StatusUnprocessableEntity, "The entity is invalid.")
+		for _, field := range validationErr.Fields {
+			p.withField(field.Field, field.Message)
+		}
+		return p
+	}
+
+	var dbErr *eram.DbError
+	if !errors.As(err, &dbErr) {
+		dbErr = &eram.DbError{Kind: eram.UnknownError, Err: err}
+	}
+
+	switch dbErr.Kind {
+	case eram.UnknownEntity:
+		return NewProblem(http.StatusNotFound, fmt.Sprintf("Entity '%s' does not exist.", entity))
+	case eram.UnknownField:
+		return NewProblem(http.StatusBadRequest, "The request references an unknown field.").
+			withField(dbErr.Field, "is not a field of this entity")
+	case eram.UniqueViolation:
+		return NewProblem(http.StatusConflict, "The entity conflicts with an existing one.").
+			withField(dbErr.Field, "must be unique")
+	case eram.NotNullViolation:
+		return NewProblem(http.StatusUnprocessableEntity, "A required field is missing.").
+			withField(dbErr.Field, "is required")
+	case eram.CheckViolation:
+		return NewProblem(http.StatusUnprocessableEntity, "A field has an invalid value.")
+	case eram.ForeignKeyViolation:
+		return NewProblem(http.StatusUnprocessableEntity, "The entity references, or is referenced by, another entity.")
+	case eram.Unavailable:
+		return NewProblem(http.StatusServiceUnavailable, "The database is busy, please retry later.")
+	}
+
+	api.logger.Printf("Unexpected error on %s: %s", entity, err)
+	return NewProblem(http.StatusInternalServerError, "")
+}
+
+// notFound returns the problem of a missing entity.
+func notFound(entity string, id string) *Problem {
+	return NewProblem(http.StatusNotFound, fmt.Sprintf("Entity '%s' with id '%s' does not exist.", entity, id))
+}
+
+// notImplemented is the problem of a feature the manager does not implement.
+func notImplemented(feature string) *Problem {
+	return NewProblem(http.StatusNotImplemented, fmt.Sprintf("The entity manager does not support %s.", feature))
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// CallProcedure calls the stored routine registered as name on the manager
+// with the arguments of the payload, an array bound in order or an object
+// bound by parameter name, and returns its result sets, e.g.
+// POST /api/_rpc/close_month {"year": 2016, "month": 1}
+func (api *EntityRestAPI) CallProcedure(w rest.ResponseWriter, r *rest.Request) {
+	name := r.PathParam("name")
+
+	caller, ok := api.em.(eram.ProcedureCaller)
+	if !ok {
+		writeProblem(w, notImplemented("stored procedures"))
+		return
+	}
+
+	var args interface{}
+	if err := r.DecodeJsonPayload(&args); err != nil && err != rest.ErrJsonPayloadEmpty {
+		writeProblem(w, NewProblem(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	resultSets, err := caller.CallProcedure(name, args)
+	if err != nil {
+		api.writeError(w, name, err)
+		return
+	}
+
+	w.WriteJson(resultSets)
+}
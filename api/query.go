@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+
+	eram "github.com/Onefootball/entity-rest-api/manager"
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// RunQuery returns the rows of the query registered as name on the manager,
+// bound to the parameters of the query string, e.g.
+// GET /api/_query/top_authors?since=2016-01-01T00:00:00Z&_perPage=10
+func (api *EntityRestAPI) RunQuery(w rest.ResponseWriter, r *rest.Request) {
+	name := r.PathParam("name")
+	runner, ok := api.em.(eram.QueryRunner)
+	if !ok {
+		writeProblem(w, notImplemented("named queries"))
+		return
+	}
+
+	// the filters of the query are its parameters
+	query, err := listQuery(r.Request.URL.Query())
+	if err != nil {
+		api.writeError(w, name, err)
+		return
+	}
+
+	allResults, count, err := runner.RunQuery(name, query)
+	if err != nil {
+		api.writeError(w, name, err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
+	w.Header().Set("X-Total-Count", fmt.Sprintf("%d", count))
+
+	etag := eram.HashEntityTag([]interface{}{count, allResults})
+	if api.writeCacheHeaders(w, r, name, etag, nil) {
+		return
+	}
+
+	w.WriteJson(allResults)
+}
@@ -32,9 +32,9 @@ func main() {
 		OriginValidator: func(origin string, request *rest.Request) bool {
 			return true
 		},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
 		AllowedHeaders: []string{
-			"Accept", "Content-Type", "X-Total-Count", "Origin"},
+			"Accept", "Content-Type", "X-Total-Count", "Origin", "If-Match"},
 		AccessControlAllowCredentials: true,
 		AccessControlMaxAge:           3600,
 	})
@@ -44,11 +44,26 @@ func main() {
 	entityRestApi := era.NewEntityRestAPI(entityManager)
 
 	router, err := rest.MakeRouter(
+		rest.Post("/api/_batch", entityRestApi.PostBatch),
+		rest.Get("/api/_query/:name", entityRestApi.RunQuery),
+		rest.Post("/api/_rpc/:name", entityRestApi.CallProcedure),
 		rest.Get("/api/:entity", entityRestApi.GetAllEntities),
+		rest.Get("/api/:entity/_aggregate", entityRestApi.AggregateEntities),
+		rest.Get("/api/:entity/_facets", entityRestApi.FacetEntities),
 		rest.Post("/api/:entity", entityRestApi.PostEntity),
 		rest.Get("/api/:entity/:id", entityRestApi.GetEntity),
 		rest.Put("/api/:entity/:id", entityRestApi.PutEntity),
+		rest.Patch("/api/:entity/:id", entityRestApi.PatchEntity),
 		rest.Delete("/api/:entity/:id", entityRestApi.DeleteEntity),
+		rest.Post("/api/:entity/:id/_restore", entityRestApi.RestoreEntity),
+		rest.Post("/api/:entity/:id/_verify", entityRestApi.VerifyEntity),
+		rest.Get("/api/:entity/:id/:child", entityRestApi.GetAllChildren),
+		rest.Post("/api/:entity/:id/:child", entityRestApi.PostChild),
+		rest.Put("/api/:entity/:id/:child", entityRestApi.PutAllChildren),
+		rest.Get("/api/:entity/:id/:child/:childId", entityRestApi.GetChild),
+		rest.Put("/api/:entity/:id/:child/:childId", entityRestApi.PutChild),
+		rest.Patch("/api/:entity/:id/:child/:childId", entityRestApi.PatchChild),
+		rest.Delete("/api/:entity/:id/:child/:childId", entityRestApi.DeleteChild),
 	)
 
 	if err != nil {
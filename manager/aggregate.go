@@ -0,0 +1,199 @@
+package manager
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	metricPattern = regexp.MustCompile(`^(?i)(count|sum|avg|min|max)\(\s*(\*|\w+)\s*\)$`)
+	havingPattern = regexp.MustCompile(`^(.+?)\s*(>=|<=|!=|=|>|<)\s*(-?\d+(?:\.\d+)?)$`)
+)
+
+// Aggregation groups the rows of an entity and computes metrics over each
+// group.
+type Aggregation struct {
+	// GroupBy are the fields the rows are grouped by. Without any, the
+	// metrics are computed over every row.
+	GroupBy []string
+	// Metrics are aggregate functions of a field, among count, sum, avg, min
+	// and max, e.g. max(create_time). count(*) counts the rows of a group.
+	Metrics []string
+	// Having are conditions on metrics, e.g. count(*) > 1, that the returned
+	// groups satisfy.
+	Having []string
+	// SortField is a grouped field or a metric, and SortDir ASC or DESC.
+	SortField string
+	SortDir   string
+}
+
+// AggregateEntities returns one row per group of the rows of entity matching
+// filterParams and opts, with the grouped fields and the metrics of the group,
+// keyed by their lowercased name, e.g. count(*).
+func (em *EntityDbManager) AggregateEntities(entity string, filterParams map[string]string, aggregation Aggregation, opts ...ReadOption) ([]map[string]interface{}, error) {
+	options := newReadOptions(opts)
+
+	whereClause, err := em.whereClause(entity, filterParams, options)
+	if err != nil {
+		return make([]map[string]interface{}, 0), err
+	}
+
+	expressions := map[string]string{}
+	var selected, groupBy []string
+
+	for _, field := range aggregation.GroupBy {
+		expr, err := em.aggregatedField(entity, "groupBy", field)
+		if err != nil {
+			return make([]map[string]interface{}, 0), err
+		}
+		expressions[field] = expr
+		selected = append(selected, fmt.Sprintf("%s AS `%s`", expr, field))
+		groupBy = append(groupBy, expr)
+	}
+
+	metrics := aggregation.Metrics
+	if len(metrics) == 0 {
+		metrics = []string{"count(*)"}
+	}
+
+	for _, metric := range metrics {
+		name, expr, err := em.metricExpression(entity, "metrics", metric)
+		if err != nil {
+			return make([]map[string]interface{}, 0), err
+		}
+		expressions[name] = expr
+		selected = append(selected, fmt.Sprintf("%s AS `%s`", expr, name))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM `%s` %s", strings.Join(selected, ", "), entity, whereClause)
+
+	if len(groupBy) > 0 {
+		query = fmt.Sprintf("%s GROUP BY %s", query, strings.Join(groupBy, ", "))
+	}
+
+	var having []string
+	for _, condition := range aggregation.Having {
+		match := havingPattern.FindStringSubmatch(strings.TrimSpace(condition))
+		if match == nil {
+			return make([]map[string]interface{}, 0), &QueryError{"having", fmt.Sprintf("%s is not a comparison of a metric with a number", condition)}
+		}
+
+		_, expr, err := em.metricExpression(entity, "having", match[1])
+		if err != nil {
+			return make([]map[string]interface{}, 0), err
+		}
+		having = append(having, fmt.Sprintf("%s %s %s", expr, match[2], match[3]))
+	}
+
+	if len(having) > 0 {
+		query = fmt.Sprintf("%s HAVING %s", query, strings.Join(having, " AND "))
+	}
+
+	if aggregation.SortField != "" {
+		name := aggregation.SortField
+		if metric, _, err := em.metricExpression(entity, "_sortField", name); err == nil {
+			name = metric
+		}
+
+		expr, ok := expressions[name]
+		if !ok {
+			return make([]map[string]interface{}, 0), &QueryError{"_sortField", fmt.Sprintf("%s is neither a grouped field nor a metric", aggregation.SortField)}
+		}
+
+		sortDir := strings.ToUpper(aggregation.SortDir)
+		if sortDir == "" {
+			sortDir = "ASC"
+		} else if sortDir != "ASC" && sortDir != "DESC" {
+			return make([]map[string]interface{}, 0), &QueryError{"_sortDir", "must be ASC or DESC"}
+		}
+
+		query = fmt.Sprintf("%s ORDER BY %s %s", query, expr, sortDir)
+	}
+
+	return em.retrieveAllResultsByQuery(query)
+}
+
+// metricExpression validates a metric and returns its name and SQL expression.
+func (em *EntityDbManager) metricExpression(entity string, param string, metric string) (string, string, error) {
+	match := metricPattern.FindStringSubmatch(strings.TrimSpace(metric))
+	if match == nil {
+		return "", "", &QueryError{param, fmt.Sprintf("%s is not one of count, sum, avg, min or max of a field", metric)}
+	}
+
+	function, field := strings.ToLower(match[1]), match[2]
+	if field == "*" {
+		if function != "count" {
+			return "", "", &QueryError{param, fmt.Sprintf("%s(*) is not allowed, only count(*)", function)}
+		}
+		return "count(*)", "COUNT(*)", nil
+	}
+
+	expr, err := em.aggregatedField(entity, param, field)
+	if err != nil {
+		return "", "", err
+	}
+
+	return fmt.Sprintf("%s(%s)", function, field), fmt.Sprintf("%s(%s)", strings.ToUpper(function), expr), nil
+}
+
+// aggregatedField returns the SQL expression of a field that is grouped or
+// aggregated: a column of entity or one of its SQL virtual fields.
+func (em *EntityDbManager) aggregatedField(entity string, param string, field string) (string, error) {
+	if _, ok := em.virtualField(entity, field); !ok {
+		columns, err := em.Columns(entity)
+		if err != nil {
+			return "", err
+		}
+
+		known := false
+		for _, column := range columns {
+			known = known || column.Name == field
+		}
+		if !known {
+			return "", &QueryError{param, fmt.Sprintf("%s is not a field of %s", field, entity)}
+		}
+	}
+
+	return em.fieldExpression(entity, field)
+}
+
+// FacetEntities returns, for each of fields, its distinct values among the
+// rows of entity matching filterParams and opts, with the number of rows
+// having each of them. Every facet is a row with a value and a count, sorted
+// by decreasing count.
+func (em *EntityDbManager) FacetEntities(entity string, filterParams map[string]string, fields []string, opts ...ReadOption) (map[string][]map[string]interface{}, error) {
+	options := newReadOptions(opts)
+	facets := map[string][]map[string]interface{}{}
+	if len(fields) == 0 {
+		return facets, &QueryError{"fields", "is required"}
+	}
+
+	whereClause, err := em.whereClause(entity, filterParams, options)
+	if err != nil {
+		return facets, err
+	}
+
+	for _, field := range fields {
+		expr, err := em.aggregatedField(entity, "fields", field)
+		if err != nil {
+			return facets, err
+		}
+
+		rows, err := em.retrieveAllResultsByQuery(fmt.Sprintf(
+			"SELECT %s AS `value`, COUNT(*) AS `count` FROM `%s` %s GROUP BY %s ORDER BY `count` DESC, %s",
+			expr,
+			entity,
+			whereClause,
+			expr,
+			expr,
+		))
+		if err != nil {
+			return facets, err
+		}
+
+		facets[field] = rows
+	}
+
+	return facets, nil
+}
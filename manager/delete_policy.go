@@ -0,0 +1,184 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeletePolicy is what happens to the children of an entity when it is
+// deleted, whatever the foreign keys of the database say.
+type DeletePolicy int
+
+const (
+	// Restrict refuses to delete an entity that still has live children, with
+	// a *RestrictError listing them.
+	Restrict DeletePolicy = iota
+	// Cascade deletes the children along with the entity, applying their own
+	// delete policies, soft delete and hooks. Through a join table, only the
+	// links are deleted.
+	Cascade
+	// SetNull clears the foreign key of the children. Through a join table,
+	// the links are deleted.
+	SetNull
+)
+
+// Children are the children of an entity through one of its relationships.
+type Children struct {
+	Relationship string
+	Entity       string
+	Ids          []interface{}
+}
+
+// RestrictError is returned when deleting an entity whose children restrict
+// its deletion.
+type RestrictError struct {
+	Entity   string
+	Id       string
+	Children []Children
+}
+
+func (e *RestrictError) Error() string {
+	names := make([]string, len(e.Children))
+	for i, children := range e.Children {
+		names[i] = children.Relationship
+	}
+	return fmt.Sprintf("%s %s is referenced by its %s", e.Entity, e.Id, strings.Join(names, ", "))
+}
+
+// SetDeletePolicy sets the policy applied to the children of entity through
+// the one-to-many or many-to-many relationship name when entity is deleted.
+// Relationships without a policy are left to the database.
+func (em *EntityDbManager) SetDeletePolicy(entity string, name string, policy DeletePolicy) {
+	if em.deletePolicies[entity] == nil {
+		em.deletePolicies[entity] = map[string]DeletePolicy{}
+	}
+	em.deletePolicies[entity][name] = policy
+}
+
+// applyDeletePolicies applies the delete policies of entity to the children
+// of row, which is about to be deleted. Restrictions are checked before any
+// child is modified.
+func (em *EntityDbManager) applyDeletePolicies(entity string, id string, row map[string]interface{}) error {
+	policies := em.deletePolicies[entity]
+	if len(policies) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	relationships := make([]Relationship, len(names))
+	for i, name := range names {
+		r, err := em.Relationship(entity, name)
+		if err != nil {
+			return err
+		} else if r.Kind == ManyToOne {
+			return &QueryError{name, fmt.Sprintf("is not a relationship to the children of %s", entity)}
+		}
+		relationships[i] = r
+	}
+
+	restricted := &RestrictError{Entity: entity, Id: id}
+	for i, r := range relationships {
+		value := row[r.LocalColumn()]
+		if policies[names[i]] != Restrict || value == nil {
+			continue
+		}
+
+		ids, err := em.childIds(r, value)
+		if err != nil {
+			return err
+		} else if len(ids) > 0 {
+			restricted.Children = append(restricted.Children, Children{r.Name, r.Target, ids})
+		}
+	}
+
+	if len(restricted.Children) > 0 {
+		return restricted
+	}
+
+	for i, r := range relationships {
+		value := row[r.LocalColumn()]
+		if policies[names[i]] == Restrict || value == nil {
+			continue
+		}
+
+		var err error
+		switch {
+		case r.Kind == ManyToMany:
+			_, err = em.conn().Exec(fmt.Sprintf(
+				"DELETE FROM `%s` WHERE `%s` = %s",
+				r.JoinKey.Entity,
+				r.ForeignKey.Column,
+				em.convertJsonValue(value),
+			))
+		case policies[names[i]] == SetNull:
+			_, err = em.conn().Exec(fmt.Sprintf(
+				"UPDATE `%s` SET `%s` = NULL WHERE `%s` = %s",
+				r.Target,
+				r.TargetColumn(),
+				r.TargetColumn(),
+				em.convertJsonValue(value),
+			))
+		default:
+			err = em.deleteChildren(r, value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// childIds returns the ids of the live children of r related to the entity
+// whose LocalColumn is value.
+func (em *EntityDbManager) childIds(r Relationship, value interface{}) ([]interface{}, error) {
+	idColumn := em.GetIdColumn(r.Target)
+	whereClause := fmt.Sprintf("`%s`.`%s` = %s", r.Target, r.TargetColumn(), em.convertJsonValue(value))
+	if r.Kind == ManyToMany {
+		whereClause = em.linkedCondition(r, value)
+	}
+
+	if condition := em.softDeleteCondition(r.Target, ExcludeDeleted); condition != "" {
+		whereClause = fmt.Sprintf("%s AND %s", whereClause, condition)
+	}
+
+	rows, err := em.retrieveAllResultsByQuery(fmt.Sprintf(
+		"SELECT `%s` FROM `%s` WHERE %s ORDER BY `%s`",
+		idColumn,
+		r.Target,
+		whereClause,
+		idColumn,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]interface{}, len(rows))
+	for i, row := range rows {
+		ids[i] = row[idColumn]
+	}
+	return ids, nil
+}
+
+// deleteChildren deletes the live children of the one-to-many relationship r
+// one by one, so their own policies, soft delete and hooks apply.
+func (em *EntityDbManager) deleteChildren(r Relationship, value interface{}) error {
+	ids, err := em.childIds(r, value)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := em.DeleteEntity(r.Target, fmt.Sprintf("%v", id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
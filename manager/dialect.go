@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+)
+
+// Dialect identifies the SQL database behind a manager.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+)
+
+// DetectDialect guesses the dialect of db from the package of its driver. It
+// defaults to MySQL, whose syntax the generated queries follow.
+func DetectDialect(db *sql.DB) Dialect {
+	if db == nil {
+		return MySQL
+	}
+
+	driver := reflect.TypeOf(db.Driver())
+	for driver.Kind() == reflect.Ptr {
+		driver = driver.Elem()
+	}
+
+	name := strings.ToLower(driver.PkgPath() + "." + driver.Name())
+	switch {
+	case strings.Contains(name, "sqlite"):
+		return SQLite
+	case strings.Contains(name, "lib/pq"), strings.Contains(name, "pgx"), strings.Contains(name, "postgres"):
+		return Postgres
+	}
+
+	return MySQL
+}
+
+// quoteString returns s as a string literal of the dialect. MySQL reads
+// backslashes in literals as escapes, so they are doubled too.
+func (d Dialect) quoteString(s string) string {
+	if d == MySQL {
+		s = strings.Replace(s, "\\", "\\\\", -1)
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// quoteIdentifier returns name as an identifier of the dialect: Postgres
+// follows the standard double quotes, which SQLite accepts as well as the
+// backticks of MySQL.
+func (d Dialect) quoteIdentifier(name string) string {
+	if d == Postgres {
+		return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+	}
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
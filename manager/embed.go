@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// finishRows completes the rows read from entity: every row is finished, the
+// requested related entities are embedded, and the fields that were not
+// requested are dropped.
+func (em *EntityDbManager) finishRows(entity string, rows []map[string]interface{}, options *readOptions) error {
+	for _, row := range rows {
+		if err := em.finishRow(entity, row, options); err != nil {
+			return err
+		}
+	}
+
+	names, err := em.embed(entity, rows, options)
+	if err != nil {
+		return err
+	}
+
+	if fields := options.projection(); fields != nil {
+		for _, name := range names {
+			fields[name] = true
+		}
+
+		for _, row := range rows {
+			for field := range row {
+				if !fields[field] {
+					delete(row, field)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkFields checks the requested fields of entity, and of the entities
+// embedded in it, against their columns, virtual fields and embedded
+// relationships. A field of an unknown entity is left to the query to report.
+func (em *EntityDbManager) checkFields(entity string, options *readOptions) error {
+	if len(options.fields) == 0 {
+		return nil
+	}
+
+	columns, err := em.Columns(entity)
+	if err != nil {
+		return nil
+	}
+
+	known := map[string]bool{"*": true}
+	for _, column := range columns {
+		known[column.Name] = true
+	}
+
+	for _, vf := range em.virtuals[entity] {
+		known[vf.Name] = true
+	}
+
+	embedded := map[string]bool{}
+	for _, path := range options.embeds {
+		name := strings.SplitN(path, ".", 2)[0]
+		known[name], embedded[name] = true, true
+	}
+
+	for field := range options.fields {
+		name := strings.SplitN(field, ".", 2)[0]
+		if strings.Contains(field, ".") && !embedded[name] {
+			return &QueryError{"_fields", fmt.Sprintf("%s is not an embedded relationship of %s", name, entity)}
+		} else if !known[name] {
+			return &QueryError{"_fields", fmt.Sprintf("%s is not a field of %s", field, entity)}
+		}
+	}
+
+	for name := range embedded {
+		r, err := em.Relationship(entity, name)
+		if err != nil {
+			return err
+		}
+
+		if err := em.checkFields(r.Target, options.related(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// embed sets the related entities requested in options on rows, and returns
+// the names of the embedded relationships. Each relationship costs a single
+// query whatever the number of rows: many-to-one relationships are embedded as
+// an object, or null, and the other ones as an array.
+func (em *EntityDbManager) embed(entity string, rows []map[string]interface{}, options *readOptions) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, path := range options.embeds {
+		name := strings.SplitN(path, ".", 2)[0]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		r, err := em.Relationship(entity, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var values []string
+		distinct := map[string]bool{}
+		for _, row := range rows {
+			if value := row[r.LocalColumn()]; value != nil && !distinct[fmt.Sprintf("%v", value)] {
+				distinct[fmt.Sprintf("%v", value)] = true
+				values = append(values, em.convertJsonValue(value))
+			}
+		}
+
+		byKey := map[string][]map[string]interface{}{}
+		if len(values) > 0 {
+			related, keys, err := em.retrieveRelated(r, values, options.related(name))
+			if err != nil {
+				return nil, err
+			}
+
+			for i, relatedRow := range related {
+				byKey[keys[i]] = append(byKey[keys[i]], relatedRow)
+			}
+		}
+
+		for _, row := range rows {
+			var matching []map[string]interface{}
+			if value := row[r.LocalColumn()]; value != nil {
+				matching = byKey[fmt.Sprintf("%v", value)]
+			}
+
+			if r.Kind != ManyToOne {
+				row[name] = append(make([]map[string]interface{}, 0), matching...)
+			} else if len(matching) > 0 {
+				row[name] = matching[0]
+			} else {
+				row[name] = nil
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// retrieveRelated reads the live entities related through r to the rows
+// whose join column is one of values, and returns them with the join column
+// values they match, which the requested fields may not include.
+func (em *EntityDbManager) retrieveRelated(r Relationship, values []string, options *readOptions) ([]map[string]interface{}, []string, error) {
+	selectClause := em.selectClause(r.Target, options)
+	from := fmt.Sprintf("`%s`", r.Target)
+	keyColumn := r.TargetColumn()
+	whereClause := fmt.Sprintf("`%s`.`%s` IN (%s)", r.Target, r.TargetColumn(), strings.Join(values, ", "))
+
+	if r.Kind == ManyToMany {
+		if selectClause == "*" {
+			selectClause = fmt.Sprintf("`%s`.*", r.Target)
+		}
+
+		// a target linked to several rows is read once per row
+		keyColumn = "_join_key"
+		selectClause = fmt.Sprintf("%s, `%s`.`%s` AS `%s`", selectClause, r.JoinKey.Entity, r.ForeignKey.Column, keyColumn)
+		from = fmt.Sprintf(
+			"`%s` JOIN `%s` ON `%s`.`%s` = `%s`.`%s`",
+			r.Target,
+			r.JoinKey.Entity,
+			r.JoinKey.Entity,
+			r.JoinKey.Column,
+			r.Target,
+			r.TargetColumn(),
+		)
+		whereClause = fmt.Sprintf("`%s`.`%s` IN (%s)", r.JoinKey.Entity, r.ForeignKey.Column, strings.Join(values, ", "))
+	}
+
+	if condition := em.softDeleteCondition(r.Target, options.deleted); condition != "" {
+		whereClause = fmt.Sprintf("%s AND %s", whereClause, condition)
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s ORDER BY `%s`.%s",
+		selectClause,
+		from,
+		whereClause,
+		r.Target,
+		em.GetIdColumn(r.Target),
+	)
+
+	rows, err := em.retrieveAllResultsByQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, len(rows))
+	for i, row := range rows {
+		keys[i] = fmt.Sprintf("%v", row[keyColumn])
+		if r.Kind == ManyToMany {
+			delete(row, keyColumn)
+		}
+	}
+
+	if err := em.finishRows(r.Target, rows, options); err != nil {
+		return nil, nil, err
+	}
+
+	return rows, keys, nil
+}
@@ -0,0 +1,257 @@
+package manager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// encryptedPrefix starts every encrypted value. Values without it were stored
+// before the field was encrypted, and are returned as is until re-encrypted.
+const encryptedPrefix = "enc:"
+
+// KeyProvider supplies the AES keys of encrypted fields, which are 16, 24 or
+// 32 bytes long. Every value records the id of the key it was encrypted with,
+// so keys can be rotated while values encrypted with older ones are still
+// readable.
+type KeyProvider interface {
+	// CurrentKey returns the key new values are encrypted with, and its id.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding its keys in memory. Rotating the key
+// means adding a new key and making it Current.
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+// Encryption configures the encryption of a field.
+type Encryption struct {
+	Keys KeyProvider
+	// BlindIndex is an optional column storing an HMAC of the plaintext, so
+	// the field can be filtered on exact values. It is never returned.
+	BlindIndex string
+	// IndexKey is the HMAC key of the blind index. Unlike encryption keys, it
+	// cannot be rotated without rebuilding the index.
+	IndexKey []byte
+}
+
+// encryptor encrypts the values of a field with AES-GCM. The entity and field
+// names are authenticated with the value, so encrypted values cannot be moved
+// to another field.
+type encryptor struct {
+	keys KeyProvider
+	aad  []byte
+}
+
+// SetEncryptedField encrypts field of entity at rest. Clients keep sending and
+// receiving plaintext values.
+func (em *EntityDbManager) SetEncryptedField(entity string, field string, encryption Encryption) {
+	em.SetFieldTransformer(entity, field, &encryptor{encryption.Keys, []byte(entity + "." + field)})
+
+	if encryption.BlindIndex != "" {
+		if em.blindIndexes[entity] == nil {
+			em.blindIndexes[entity] = map[string]blindIndex{}
+		}
+		em.blindIndexes[entity][field] = blindIndex{encryption.BlindIndex, encryption.IndexKey}
+	}
+}
+
+func (e *encryptor) Write(value interface{}) (interface{}, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(fmt.Sprintf("%v", value)), e.aad)
+
+	return fmt.Sprintf("%s%s:%s", encryptedPrefix, id, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+func (e *encryptor) Read(value interface{}) (interface{}, bool, error) {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+		return value, true, nil
+	}
+
+	// key ids may contain colons, base64 never does; a value without a key id
+	// only looks encrypted, and is plaintext stored before the encryption
+	sep := strings.LastIndex(s, ":")
+	if sep <= len(encryptedPrefix) {
+		return value, true, nil
+	}
+	id := s[len(encryptedPrefix):sep]
+
+	sealed, err := base64.StdEncoding.DecodeString(s[sep+1:])
+	if err != nil {
+		return nil, false, err
+	}
+
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, false, fmt.Errorf("encrypted value is too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], e.aad)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return string(plaintext), true, nil
+}
+
+// current reports whether a stored value is encrypted with the current key.
+func (e *encryptor) current(value interface{}) (bool, error) {
+	id, _, err := e.keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+
+	s, _ := value.(string)
+	return strings.HasPrefix(s, encryptedPrefix+id+":") && strings.LastIndex(s, ":") == len(encryptedPrefix)+len(id), nil
+}
+
+// maxLength returns the length in bytes of the longest value whose encryption
+// with the current key fits in length characters.
+func (e *encryptor) maxLength(length int) (int, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// the nonce and the sealed value are base64 encoded after the key id
+	encoded := length - len(encryptedPrefix) - len(id) - 1
+	return encoded/4*3 - aead.NonceSize() - aead.Overhead(), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blindIndex is a column storing an HMAC of the plaintext of an encrypted field.
+type blindIndex struct {
+	column string
+	key    []byte
+}
+
+func (bi blindIndex) hash(value interface{}) string {
+	mac := hmac.New(sha256.New, bi.key)
+	mac.Write([]byte(fmt.Sprintf("%v", value)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReencryptEntity encrypts every value of the encrypted fields of entity that
+// is not encrypted with the current key, and fills their blind indexes. It
+// is meant to be run after a key rotation, or after encrypting a field of
+// existing rows, and returns the number of updated rows.
+func (em *EntityDbManager) ReencryptEntity(entity string) (int64, error) {
+	var updated int64
+
+	err := em.Transaction(func(txm *EntityDbManager) error {
+		rows, err := txm.retrieveAllResultsByQuery(fmt.Sprintf("SELECT * FROM `%s`", entity))
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			data := map[string]interface{}{}
+
+			for field, transformer := range txm.transformers[entity] {
+				e, ok := transformer.(*encryptor)
+				if !ok || row[field] == nil {
+					continue
+				}
+
+				if current, err := e.current(row[field]); err != nil {
+					return err
+				} else if current {
+					continue
+				}
+
+				if data[field], _, err = e.Read(row[field]); err != nil {
+					return err
+				}
+			}
+
+			if len(data) == 0 {
+				continue
+			}
+
+			if err := txm.transformWrite(entity, data); err != nil {
+				return err
+			}
+
+			var updateSet []string
+			for column, value := range data {
+				updateSet = append(updateSet, fmt.Sprintf("`%s` = %s", column, txm.convertJsonValue(value)))
+			}
+
+			_, err := txm.conn().Exec(fmt.Sprintf(
+				"UPDATE `%s` SET %s WHERE %s = %s",
+				entity,
+				strings.Join(updateSet, ", "),
+				txm.GetIdColumn(entity),
+				txm.convertJsonValue(row[txm.GetIdColumn(entity)]),
+			))
+			if err != nil {
+				return err
+			}
+
+			updated++
+		}
+
+		return nil
+	})
+
+	return updated, err
+}
@@ -10,9 +10,40 @@ import (
 
 const DefaultIdColumn = "id"
 
+// ErrPreconditionFailed is returned when a conditional write does not match
+// the current state of the entity.
+var ErrPreconditionFailed = newManagerError("precondition failed")
+
+// dbExecutor is implemented by both *sql.DB and *sql.Tx, so the manager can
+// run its queries either in autocommit mode or inside a transaction.
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type EntityDbManager struct {
-	Db        *sql.DB
-	EntityMap map[string]string
+	Db             *sql.DB
+	EntityMap      map[string]string
+	Dialect        Dialect
+	versions       map[string]string
+	lastModified   map[string]string
+	softDeletes    map[string]softDelete
+	timestamps     map[string]TimestampColumns
+	rules          map[string]map[string][]Rule
+	hooks          map[string]map[HookEvent][]Hook
+	virtuals       map[string][]VirtualField
+	transformers   map[string]map[string]FieldTransformer
+	blindIndexes   map[string]map[string]blindIndex
+	foreignKeys    []ForeignKey
+	joinTables     []JoinTable
+	schema         *schemaCache
+	tx             *sql.Tx
+	deletePolicies map[string]map[string]DeletePolicy
+	searchIndexes  map[string]SearchIndex
+	foldAccents    bool
+	queries        map[string]namedQuery
+	procedures     map[string]Procedure
 }
 
 func NewEntityDbManager(db *sql.DB) *EntityDbManager {
@@ -21,9 +52,76 @@ func NewEntityDbManager(db *sql.DB) *EntityDbManager {
 
 func NewEntityDbManagerWithEntityMap(db *sql.DB, entityMap map[string]string) *EntityDbManager {
 	return &EntityDbManager{
-		db,
-		entityMap,
+		Db:             db,
+		EntityMap:      entityMap,
+		Dialect:        DetectDialect(db),
+		versions:       map[string]string{},
+		lastModified:   map[string]string{},
+		softDeletes:    map[string]softDelete{},
+		timestamps:     map[string]TimestampColumns{},
+		rules:          map[string]map[string][]Rule{},
+		hooks:          map[string]map[HookEvent][]Hook{},
+		virtuals:       map[string][]VirtualField{},
+		transformers:   map[string]map[string]FieldTransformer{},
+		blindIndexes:   map[string]map[string]blindIndex{},
+		schema:         newSchemaCache(),
+		deletePolicies: map[string]map[string]DeletePolicy{},
+		searchIndexes:  map[string]SearchIndex{},
+		queries:        map[string]namedQuery{},
+		procedures:     map[string]Procedure{},
+	}
+}
+
+// SetVersionColumn declares an integer column of entity that is incremented on
+// every update and used as the entity tag instead of a hash of the row.
+func (em *EntityDbManager) SetVersionColumn(entity string, column string) {
+	em.versions[entity] = column
+}
+
+// GetVersionColumn returns the version column of entity, if any.
+func (em *EntityDbManager) GetVersionColumn(entity string) (string, bool) {
+	v, ok := em.versions[entity]
+	return v, ok
+}
+
+// Transaction runs fn inside a single database transaction. The manager passed
+// to fn is bound to the transaction, which is committed when fn returns nil and
+// rolled back otherwise. Calling Transaction on a manager that is already bound
+// to a transaction reuses it.
+func (em *EntityDbManager) Transaction(fn func(txm *EntityDbManager) error) error {
+	if em.tx != nil {
+		return fn(em)
+	}
+
+	tx, err := em.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	txm := *em
+	txm.tx = tx
+
+	if err := fn(&txm); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// conn returns the transaction the manager is bound to, or the database handle.
+func (em *EntityDbManager) conn() dbExecutor {
+	if em.tx != nil {
+		return em.tx
 	}
+	return em.Db
 }
 
 func (em *EntityDbManager) GetIdColumn(entity string) string {
@@ -33,44 +131,83 @@ func (em *EntityDbManager) GetIdColumn(entity string) string {
 	return DefaultIdColumn
 }
 
-func (em *EntityDbManager) GetEntities(entity string, filterParams map[string]string, limit string, offset string, orderBy string, orderDir string) ([]map[string]interface{}, int, error) {
-	var whereClause string = ""
-	if len(filterParams) > 0 {
-		var whereConditions []string
-		r := strings.NewReplacer("*", "%")
+func (em *EntityDbManager) GetEntities(entity string, filterParams map[string]string, limit string, offset string, orderBy string, orderDir string, opts ...ReadOption) ([]map[string]interface{}, int, error) {
+	query := Query{Filters: filterParams, SortField: orderBy, SortDir: orderDir, Options: opts}
 
-		for filterParamKey, filterParamVal := range filterParams {
-			wherePiece := fmt.Sprintf("`%s` LIKE '%s'", filterParamKey, r.Replace(filterParamVal))
-			whereConditions = append(whereConditions, wherePiece)
-		}
+	var err error
+	if query.Limit, err = strconv.Atoi(limit); err != nil {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_perPage", "must be an integer"}
+	} else if query.Offset, err = strconv.Atoi(offset); err != nil {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_page", "must be an integer"}
+	}
 
-		whereClause = fmt.Sprintf("WHERE %s", strings.Join(whereConditions, " AND "))
+	return em.ListEntities(entity, query)
+}
+
+// ListEntities returns the page of entities selected by query, with the total
+// number of entities matching its filters.
+func (em *EntityDbManager) ListEntities(entity string, query Query) ([]map[string]interface{}, int, error) {
+	options := newReadOptions(query.Options)
+	if err := em.checkFields(entity, options); err != nil {
+		return make([]map[string]interface{}, 0), 0, err
 	}
 
-	query := fmt.Sprintf(
-		"SELECT * FROM `%s` %s ORDER BY %s %s LIMIT %s, %s",
-		entity,
+	orderBy, orderDir := query.SortField, strings.ToUpper(query.SortDir)
+	if orderBy == "" {
+		orderBy = em.GetIdColumn(entity)
+	}
+
+	if orderDir == "" {
+		orderDir = "ASC"
+	} else if orderDir != "ASC" && orderDir != "DESC" {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_sortDir", "must be ASC or DESC"}
+	}
+
+	whereClause, err := em.whereClause(entity, query.Filters, options)
+	if err != nil {
+		return make([]map[string]interface{}, 0), 0, err
+	}
+
+	if orderBy == ScoreField {
+		if options.search == "" {
+			return make([]map[string]interface{}, 0), 0, &QueryError{"_sort", "_score requires a _q search"}
+		}
+		if _, orderBy, err = em.searchCondition(entity, options.search); err != nil {
+			return make([]map[string]interface{}, 0), 0, err
+		}
+	} else if vf, ok := em.virtualField(entity, orderBy); ok {
+		if orderBy, err = em.fieldExpression(entity, vf.Name); err != nil {
+			return make([]map[string]interface{}, 0), 0, err
+		}
+	}
+
+	allResults, err := em.retrieveAllResultsByQuery(fmt.Sprintf(
+		"SELECT %s FROM %s %s ORDER BY %s %s LIMIT %d OFFSET %d",
+		em.selectClause(entity, options),
+		em.Dialect.quoteIdentifier(entity),
 		whereClause,
 		orderBy,
 		orderDir,
-		offset,
-		limit,
-	)
-
-	allResults, err := em.retrieveAllResultsByQuery(query)
+		query.Limit,
+		query.Offset,
+	))
 	if err != nil {
 		return make([]map[string]interface{}, 0), 0, err
 	}
 
+	if err := em.finishRows(entity, allResults, options); err != nil {
+		return make([]map[string]interface{}, 0), 0, err
+	}
+
 	var countResult string
 	countQuery := fmt.Sprintf(
-		"SELECT count(%s) FROM `%s`%s",
+		"SELECT count(%s) FROM %s %s",
 		em.GetIdColumn(entity),
-		entity,
+		em.Dialect.quoteIdentifier(entity),
 		whereClause,
 	)
 
-	countErr := em.Db.QueryRow(countQuery).Scan(&countResult)
+	countErr := em.conn().QueryRow(countQuery).Scan(&countResult)
 	if countErr != nil {
 		return make([]map[string]interface{}, 0), 0, countErr
 	}
@@ -80,60 +217,98 @@ func (em *EntityDbManager) GetEntities(entity string, filterParams map[string]st
 	return allResults, count, nil
 }
 
-func (em *EntityDbManager) GetEntity(entity string, id string) (map[string]interface{}, error) {
-	result, err := em.retrieveSingleResultById(entity, id)
+func (em *EntityDbManager) GetEntity(entity string, id string, opts ...ReadOption) (map[string]interface{}, error) {
+	options := newReadOptions(opts)
+	if err := em.checkFields(entity, options); err != nil {
+		return make(map[string]interface{}), err
+	}
+
+	result, err := em.retrieveSingleResult(entity, id, options)
 	if err != nil {
 		return make(map[string]interface{}), err
 	}
 
+	if len(result) > 0 {
+		if err := em.finishRows(entity, []map[string]interface{}{result}, options); err != nil {
+			return make(map[string]interface{}), err
+		}
+	}
+
 	return result, nil
 }
 
 func (em *EntityDbManager) PostEntity(entity string, postData map[string]interface{}) (int64, error) {
-	columnsQuery := fmt.Sprintf(
-		"SHOW COLUMNS FROM `%s`",
-		entity,
-	)
+	var newId int64
 
-	var columns []string
-	var values []string
+	err := em.Transaction(func(txm *EntityDbManager) error {
+		hc := &HookContext{Manager: txm, Entity: entity, Data: txm.stampCreate(entity, copyData(postData))}
+		if err := txm.runHooks(BeforeCreate, hc); err != nil {
+			return err
+		}
 
-	columnsResult, err := em.retrieveAllResultsByQuery(columnsQuery)
+		if err := txm.Validate(entity, hc.Data, true); err != nil {
+			return err
+		}
 
-	// if there is an error in SHOW COLUMNS all fields are required
-	if err != nil {
-		for postDataKey, postDataVal := range postData {
-			columns = append(columns, fmt.Sprintf("`%s`", postDataKey))
-			values = append(values, em.convertJsonValue(postDataVal))
-		}
-	} else {
-		for _, columnsRow := range columnsResult {
-			column := columnsRow["Field"].(string)
-			if column == em.GetIdColumn(entity) {
-				continue
-			}
+		if err := txm.transformWrite(entity, hc.Data); err != nil {
+			return err
+		}
+
+		var columns []string
+		var values []string
+
+		columnsResult, err := txm.Columns(entity)
 
-			_, ok := postData[column]
-			if ok {
-				columns = append(columns, fmt.Sprintf("`%s`", column))
-				values = append(values, em.convertJsonValue(postData[column]))
+		// the id is left to the database on MySQL only, other dialects insert
+		// every field of the payload, which has been validated against the schema
+		if err != nil || txm.Dialect != MySQL {
+			for postDataKey, postDataVal := range hc.Data {
+				columns = append(columns, fmt.Sprintf("`%s`", postDataKey))
+				values = append(values, txm.convertJsonValue(postDataVal))
+			}
+		} else {
+			for _, column := range columnsResult {
+				if column.Name == txm.GetIdColumn(entity) {
+					continue
+				}
+
+				_, ok := hc.Data[column.Name]
+				if ok {
+					columns = append(columns, fmt.Sprintf("`%s`", column.Name))
+					values = append(values, txm.convertJsonValue(hc.Data[column.Name]))
+				}
 			}
 		}
-	}
 
-	insertQuery := fmt.Sprintf(
-		"INSERT INTO `%s` (%s) VALUES(%s)",
-		entity,
-		strings.Join(columns, ", "),
-		strings.Join(values, ", "),
-	)
+		insertQuery := fmt.Sprintf(
+			"INSERT INTO `%s` (%s) VALUES(%s)",
+			entity,
+			strings.Join(columns, ", "),
+			strings.Join(values, ", "),
+		)
 
-	res, err := em.Db.Exec(insertQuery)
-	if err != nil {
-		return 0, err
-	}
+		res, err := txm.conn().Exec(insertQuery)
+		if err != nil {
+			return err
+		}
+
+		newId, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		if !txm.hasHooks(entity, AfterCreate) {
+			return nil
+		}
+
+		hc.Id = strconv.FormatInt(newId, 10)
+		if hc.Row, err = txm.retrieveSingleResultById(entity, hc.Id, WithDeleted); err != nil {
+			return err
+		}
+
+		return txm.runHooks(AfterCreate, hc)
+	})
 
-	newId, err := res.LastInsertId()
 	if err != nil {
 		return 0, err
 	}
@@ -142,62 +317,201 @@ func (em *EntityDbManager) PostEntity(entity string, postData map[string]interfa
 }
 
 func (em *EntityDbManager) UpdateEntity(entity string, id string, updateData map[string]interface{}) (int64, map[string]interface{}, error) {
-	entityToUpdate, err := em.retrieveSingleResultById(entity, id)
-	if err != nil {
-		return 0, make(map[string]interface{}), err
-	} else if len(entityToUpdate) <= 0 {
-		return 0, entityToUpdate, nil
-	}
+	return em.UpdateEntityIfMatch(entity, id, updateData, "")
+}
+
+// UpdateEntityIfMatch updates the entity only when ifMatch, an If-Match header
+// value, matches its current entity tag. An empty ifMatch always matches.
+// ErrPreconditionFailed is returned on mismatch, or when the version column
+// shows the entity was modified concurrently. Without version column, the row
+// is locked from the moment it is read on MySQL and Postgres, so it cannot
+// change between the check and the update; SQLite fails the concurrent
+// transaction instead.
+func (em *EntityDbManager) UpdateEntityIfMatch(entity string, id string, updateData map[string]interface{}, ifMatch string) (int64, map[string]interface{}, error) {
+	var rowsAffected int64
+	var updatedEntity map[string]interface{}
+
+	err := em.Transaction(func(txm *EntityDbManager) error {
+		versionColumn, versioned := txm.GetVersionColumn(entity)
+
+		entityToUpdate, err := txm.retrieveSingleResult(entity, id, &readOptions{deleted: ExcludeDeleted, locked: ifMatch != "" && !versioned})
+		if err != nil {
+			return err
+		} else if len(entityToUpdate) <= 0 {
+			updatedEntity = entityToUpdate
+			return nil
+		}
 
-	var updateSet []string
-	for updKey, _ := range entityToUpdate {
-		_, ok := updateData[updKey]
+		if ifMatch != "" {
+			etag, err := txm.readEntityTag(entity, entityToUpdate)
+			if err != nil {
+				return err
+			} else if !MatchEntityTag(ifMatch, etag) {
+				return ErrPreconditionFailed
+			}
+		}
 
-		if ok {
-			entityToUpdate[updKey] = em.convertJsonValue(updateData[updKey])
-			updateSet = append(updateSet, fmt.Sprintf("`%s` = %s", updKey, entityToUpdate[updKey]))
+		hc := &HookContext{Manager: txm, Entity: entity, Id: id, Data: copyData(updateData), Row: entityToUpdate}
+		if err := txm.runHooks(BeforeUpdate, hc); err != nil {
+			return err
 		}
-	}
+		updateData = hc.Data
 
-	if len(updateSet) <= 0 {
-		return 0, entityToUpdate, nil
-	}
+		if err := txm.Validate(entity, updateData, false); err != nil {
+			return err
+		}
 
-	updQuery := fmt.Sprintf(
-		"UPDATE `%s` SET %s WHERE %s = %s",
-		entity,
-		strings.Join(updateSet, ", "),
-		em.GetIdColumn(entity),
-		id,
-	)
+		if err := txm.transformWrite(entity, updateData); err != nil {
+			return err
+		}
 
-	res, err := em.Db.Exec(updQuery)
-	if err != nil {
-		return 0, make(map[string]interface{}), err
+		var updateSet []string
+		for updKey, _ := range entityToUpdate {
+			_, ok := updateData[updKey]
+
+			if ok && !(versioned && updKey == versionColumn) && !txm.isManagedTimestamp(entity, updKey) {
+				updateSet = append(updateSet, fmt.Sprintf("`%s` = %s", updKey, txm.convertJsonValue(updateData[updKey])))
+			}
+		}
+
+		if len(updateSet) <= 0 {
+			updatedEntity = entityToUpdate
+			return nil
+		}
+
+		if ts, ok := txm.timestamps[entity]; ok && ts.Updated != "" {
+			updateSet = append(updateSet, fmt.Sprintf("`%s` = %s", ts.Updated, txm.convertJsonValue(txm.timestampValue(entity))))
+		}
+
+		whereClause := fmt.Sprintf("%s = %s", txm.GetIdColumn(entity), id)
+		if versioned {
+			updateSet = append(updateSet, fmt.Sprintf("`%s` = `%s` + 1", versionColumn, versionColumn))
+			whereClause = fmt.Sprintf("%s AND `%s` = %s", whereClause, versionColumn, txm.convertJsonValue(entityToUpdate[versionColumn]))
+		}
+
+		updQuery := fmt.Sprintf(
+			"UPDATE `%s` SET %s WHERE %s",
+			entity,
+			strings.Join(updateSet, ", "),
+			whereClause,
+		)
+
+		res, err := txm.conn().Exec(updQuery)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err = res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if versioned && rowsAffected == 0 {
+			return ErrPreconditionFailed
+		}
+
+		updatedEntity, err = txm.retrieveSingleResultById(entity, id, ExcludeDeleted)
+		if err != nil {
+			return err
+		}
+
+		hc.Row = updatedEntity
+		return txm.runHooks(AfterUpdate, hc)
+	})
+
+	// the updated entity is returned as GET returns it
+	if err == nil && len(updatedEntity) > 0 {
+		err = em.finishRow(entity, updatedEntity, &readOptions{})
 	}
 
-	rowsAffected, err := res.RowsAffected()
 	if err != nil {
 		return 0, make(map[string]interface{}), err
 	}
 
-	return rowsAffected, entityToUpdate, nil
+	return rowsAffected, updatedEntity, nil
 }
 
 func (em *EntityDbManager) DeleteEntity(entity string, id string) (int64, error) {
-	query := fmt.Sprintf(
-		"DELETE FROM `%s` WHERE %s = %s",
-		entity,
-		em.GetIdColumn(entity),
-		id,
-	)
+	return em.DeleteEntityIfMatch(entity, id, "")
+}
 
-	res, err := em.Db.Exec(query)
-	if err != nil {
-		return 0, err
-	}
+// DeleteEntityIfMatch deletes the entity only when ifMatch, an If-Match header
+// value, matches its current entity tag. An empty ifMatch always matches. The
+// row is locked as by UpdateEntityIfMatch.
+func (em *EntityDbManager) DeleteEntityIfMatch(entity string, id string, ifMatch string) (int64, error) {
+	var rowsAffected int64
+
+	err := em.Transaction(func(txm *EntityDbManager) error {
+		whereClause := fmt.Sprintf("%s = %s", txm.GetIdColumn(entity), id)
+		hc := &HookContext{Manager: txm, Entity: entity, Id: id}
+
+		versionColumn, versioned := txm.GetVersionColumn(entity)
+
+		if ifMatch != "" || txm.hasHooks(entity, BeforeDelete, AfterDelete) || len(txm.deletePolicies[entity]) > 0 {
+			entityToDelete, err := txm.retrieveSingleResult(entity, id, &readOptions{deleted: ExcludeDeleted, locked: ifMatch != "" && !versioned})
+			if err != nil || len(entityToDelete) <= 0 {
+				return err
+			}
+
+			if ifMatch != "" {
+				etag, err := txm.readEntityTag(entity, entityToDelete)
+				if err != nil {
+					return err
+				} else if !MatchEntityTag(ifMatch, etag) {
+					return ErrPreconditionFailed
+				}
+			}
+
+			if versioned && ifMatch != "" {
+				whereClause = fmt.Sprintf("%s AND `%s` = %s", whereClause, versionColumn, txm.convertJsonValue(entityToDelete[versionColumn]))
+			}
+
+			hc.Row = entityToDelete
+			if err := txm.runHooks(BeforeDelete, hc); err != nil {
+				return err
+			}
+
+			if err := txm.applyDeletePolicies(entity, id, entityToDelete); err != nil {
+				return err
+			}
+		}
+
+		query := fmt.Sprintf(
+			"DELETE FROM `%s` WHERE %s",
+			entity,
+			whereClause,
+		)
+
+		if sd, ok := txm.softDeletes[entity]; ok {
+			query = fmt.Sprintf(
+				"UPDATE `%s` SET `%s` = %s WHERE %s AND %s",
+				entity,
+				sd.column,
+				sd.deletedValue(),
+				whereClause,
+				txm.softDeleteCondition(entity, ExcludeDeleted),
+			)
+		}
+
+		res, err := txm.conn().Exec(query)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err = res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ifMatch != "" && rowsAffected == 0 {
+			return ErrPreconditionFailed
+		} else if rowsAffected == 0 {
+			return nil
+		}
+
+		return txm.runHooks(AfterDelete, hc)
+	})
 
-	rowsAffected, err := res.RowsAffected()
 	if err != nil {
 		return 0, err
 	}
@@ -205,11 +519,30 @@ func (em *EntityDbManager) DeleteEntity(entity string, id string) (int64, error)
 	return rowsAffected, nil
 }
 
-func (em *EntityDbManager) retrieveAllResultsByQuery(query string) ([]map[string]interface{}, error) {
-	allResults := make([]map[string]interface{}, 0)
-	rows, err := em.Db.Query(query)
+// afterRead runs the AfterRead hooks of entity on a row about to be returned.
+func (em *EntityDbManager) afterRead(entity string, row map[string]interface{}) error {
+	return em.runHooks(AfterRead, &HookContext{
+		Manager: em,
+		Entity:  entity,
+		Id:      fmt.Sprintf("%v", row[em.GetIdColumn(entity)]),
+		Row:     row,
+	})
+}
+
+// copyData returns a shallow copy of a payload, so hooks and timestamps do not
+// modify the map of the caller.
+func copyData(data map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		copied[key] = value
+	}
+	return copied
+}
+
+func (em *EntityDbManager) retrieveAllResultsByQuery(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := em.conn().Query(query, args...)
 	if err != nil {
-		return allResults, err
+		return make([]map[string]interface{}, 0), err
 	}
 
 	defer func() {
@@ -218,6 +551,13 @@ func (em *EntityDbManager) retrieveAllResultsByQuery(query string) ([]map[string
 		}
 	}()
 
+	return em.scanRows(rows)
+}
+
+// scanRows reads the rows of the current result set of rows.
+func (em *EntityDbManager) scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	allResults := make([]map[string]interface{}, 0)
+
 	cols, err := rows.Columns()
 	if err != nil {
 		return allResults, err
@@ -243,19 +583,34 @@ func (em *EntityDbManager) retrieveAllResultsByQuery(query string) ([]map[string
 		allResults = append(allResults, result)
 	}
 
-	return allResults, nil
+	return allResults, rows.Err()
+}
+
+func (em *EntityDbManager) retrieveSingleResultById(entity string, id string, scope DeletedScope) (map[string]interface{}, error) {
+	return em.retrieveSingleResult(entity, id, &readOptions{deleted: scope})
 }
 
-func (em *EntityDbManager) retrieveSingleResultById(entity string, id string) (map[string]interface{}, error) {
+func (em *EntityDbManager) retrieveSingleResult(entity string, id string, options *readOptions) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
+	whereClause := fmt.Sprintf("`%s`.%s = %s", entity, em.GetIdColumn(entity), id)
+	for _, condition := range em.whereConditions(entity, options) {
+		whereClause = fmt.Sprintf("%s AND %s", whereClause, condition)
+	}
+	if condition := em.softDeleteCondition(entity, options.deleted); condition != "" {
+		whereClause = fmt.Sprintf("%s AND %s", whereClause, condition)
+	}
+
 	query := fmt.Sprintf(
-		"SELECT * FROM `%s` WHERE %s = %s",
+		"SELECT %s FROM `%s` WHERE %s",
+		em.selectClause(entity, options),
 		entity,
-		em.GetIdColumn(entity),
-		id,
+		whereClause,
 	)
+	if options.locked && em.Dialect != SQLite {
+		query += " FOR UPDATE"
+	}
 
-	rows, err := em.Db.Query(query)
+	rows, err := em.conn().Query(query)
 	if err != nil {
 		return result, err
 	}
@@ -308,6 +663,8 @@ func (em *EntityDbManager) convertDbValue(dbValue interface{}) interface{} {
 		return dbValue.(int)
 	case int64:
 		return dbValue.(int64)
+	case float64:
+		return dbValue.(float64)
 	case []byte:
 		return string(dbValue.([]byte))
 	case string:
@@ -333,7 +690,7 @@ func (em *EntityDbManager) convertJsonValue(jsonValue interface{}) string {
 	case float64:
 		return strconv.Itoa(int(jsonValue.(float64)))
 	case string:
-		return fmt.Sprintf("'%s'", strings.Replace(jsonValue.(string), "'", "\\'", -1))
+		return em.Dialect.quoteString(jsonValue.(string))
 	case nil:
 		return "NULL"
 	}
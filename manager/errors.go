@@ -0,0 +1,229 @@
+package manager
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrorKind is the class of a database error.
+type ErrorKind int
+
+const (
+	UnknownError ErrorKind = iota
+	UnknownEntity
+	UnknownField
+	UniqueViolation
+	NotNullViolation
+	CheckViolation
+	ForeignKeyViolation
+	Unavailable
+)
+
+// DbError is a database error classified by the dialect that produced it.
+// Field is the column involved in the error, when the driver reports it.
+type DbError struct {
+	Kind  ErrorKind
+	Field string
+	Err   error
+}
+
+func (e *DbError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DbError) Unwrap() error {
+	return e.Err
+}
+
+// NotSupportedError reports a feature the manager or its database does not
+// support.
+type NotSupportedError struct {
+	Feature string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s are not supported", e.Feature)
+}
+
+var (
+	mysqlErrorCode    = regexp.MustCompile(`^Error (\d+)`)
+	postgresSQLState  = regexp.MustCompile(`SQLSTATE ([0-9A-Z]{5})`)
+	quotedName        = regexp.MustCompile("['\"`]([^'\"`]+)['\"`]")
+	sqliteColumnName  = regexp.MustCompile(`(?:constraint failed|no such column|has no column named): (?:\w+\.)?(\w+)`)
+	mysqlDuplicateKey = regexp.MustCompile(`for key '(?:\w+\.)?(\w+)'`)
+)
+
+// managerError is implemented by the errors of the manager itself, as opposed
+// to the errors of the database, so ClassifyError returns them unchanged.
+type managerError interface {
+	error
+	managerError()
+}
+
+// sentinelError is a managerError without details, such as
+// ErrPreconditionFailed.
+type sentinelError struct {
+	message string
+}
+
+func newManagerError(message string) error {
+	return &sentinelError{message}
+}
+
+func (e *sentinelError) Error() string {
+	return e.message
+}
+
+func (*sentinelError) managerError()     {}
+func (*DbError) managerError()           {}
+func (*ValidationError) managerError()   {}
+func (*HookError) managerError()         {}
+func (*QueryError) managerError()        {}
+func (*RestrictError) managerError()     {}
+func (*NotSupportedError) managerError() {}
+
+// ClassifyError wraps err in a *DbError describing its kind. Errors of the
+// manager itself, such as ErrPreconditionFailed or a *ValidationError, are
+// returned unchanged.
+func (em *EntityDbManager) ClassifyError(err error) error {
+	var managerErr managerError
+	if err == nil || errors.As(err, &managerErr) {
+		return err
+	}
+
+	return em.Dialect.ClassifyError(err)
+}
+
+// ClassifyError classifies err according to the error codes and messages of
+// the dialect.
+func (d Dialect) ClassifyError(err error) *DbError {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) {
+		return &DbError{Kind: Unavailable, Err: err}
+	}
+
+	switch d {
+	case SQLite:
+		return classifySQLiteError(err)
+	case Postgres:
+		return classifyPostgresError(err)
+	}
+
+	return classifyMySQLError(err)
+}
+
+func classifySQLiteError(err error) *DbError {
+	msg := err.Error()
+	dbErr := &DbError{Kind: UnknownError, Err: err}
+
+	switch {
+	case strings.HasPrefix(msg, "no such table"):
+		dbErr.Kind = UnknownEntity
+	case strings.HasPrefix(msg, "no such column"), strings.Contains(msg, "has no column named"):
+		dbErr.Kind = UnknownField
+	case strings.HasPrefix(msg, "UNIQUE constraint failed"):
+		dbErr.Kind = UniqueViolation
+	case strings.HasPrefix(msg, "NOT NULL constraint failed"):
+		dbErr.Kind = NotNullViolation
+	case strings.HasPrefix(msg, "CHECK constraint failed"):
+		dbErr.Kind = CheckViolation
+	case strings.HasPrefix(msg, "FOREIGN KEY constraint failed"):
+		dbErr.Kind = ForeignKeyViolation
+	case strings.HasPrefix(msg, "database is locked"), strings.HasPrefix(msg, "database table is locked"):
+		dbErr.Kind = Unavailable
+	}
+
+	if match := sqliteColumnName.FindStringSubmatch(msg); match != nil && dbErr.Kind != CheckViolation {
+		dbErr.Field = match[1]
+	}
+
+	return dbErr
+}
+
+func classifyMySQLError(err error) *DbError {
+	msg := err.Error()
+	dbErr := &DbError{Kind: UnknownError, Err: err}
+
+	match := mysqlErrorCode.FindStringSubmatch(msg)
+	if match == nil {
+		return dbErr
+	}
+
+	switch code, _ := strconv.Atoi(match[1]); code {
+	case 1146:
+		dbErr.Kind = UnknownEntity
+	case 1054:
+		dbErr.Kind = UnknownField
+	case 1062:
+		dbErr.Kind = UniqueViolation
+		if key := mysqlDuplicateKey.FindStringSubmatch(msg); key != nil {
+			dbErr.Field = key[1]
+		}
+		return dbErr
+	case 1048, 1364:
+		dbErr.Kind = NotNullViolation
+	case 3819:
+		dbErr.Kind = CheckViolation
+		return dbErr
+	case 1216, 1217, 1451, 1452:
+		dbErr.Kind = ForeignKeyViolation
+		return dbErr
+	case 1205, 1213:
+		dbErr.Kind = Unavailable
+		return dbErr
+	}
+
+	if name := quotedName.FindStringSubmatch(msg); name != nil && dbErr.Kind != UnknownEntity {
+		dbErr.Field = name[1]
+	}
+
+	return dbErr
+}
+
+func classifyPostgresError(err error) *DbError {
+	msg := err.Error()
+	dbErr := &DbError{Kind: UnknownError, Err: err}
+
+	// lib/pq and pgx errors both expose their code through SQLState
+	var state string
+	var stater interface{ SQLState() string }
+	if errors.As(err, &stater) {
+		state = stater.SQLState()
+	} else if match := postgresSQLState.FindStringSubmatch(msg); match != nil {
+		state = match[1]
+	}
+
+	switch state {
+	case "42P01":
+		dbErr.Kind = UnknownEntity
+		return dbErr
+	case "42703":
+		dbErr.Kind = UnknownField
+	case "23505":
+		dbErr.Kind = UniqueViolation
+		return dbErr
+	case "23502":
+		dbErr.Kind = NotNullViolation
+	case "23514":
+		dbErr.Kind = CheckViolation
+		return dbErr
+	case "23503":
+		dbErr.Kind = ForeignKeyViolation
+		return dbErr
+	case "40001", "40P01", "55P03", "57014":
+		dbErr.Kind = Unavailable
+		return dbErr
+	default:
+		return dbErr
+	}
+
+	if name := quotedName.FindStringSubmatch(msg); name != nil {
+		dbErr.Field = name[1]
+	}
+
+	return dbErr
+}
@@ -0,0 +1,40 @@
+package manager
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EntityTag returns the strong entity tag of a row, quoted as expected by the
+// ETag header. It is the value of the version column when entity has one, and
+// a hash of the row otherwise.
+func (em *EntityDbManager) EntityTag(entity string, row map[string]interface{}) string {
+	if versionColumn, ok := em.GetVersionColumn(entity); ok {
+		if version, ok := row[versionColumn]; ok && version != nil {
+			return fmt.Sprintf("\"%v\"", version)
+		}
+	}
+
+	return HashEntityTag(row)
+}
+
+// HashEntityTag returns a strong entity tag computed from the JSON encoding of v.
+func HashEntityTag(v interface{}) string {
+	// map keys are sorted by encoding/json, so equal rows hash the same
+	b, _ := json.Marshal(v)
+	return fmt.Sprintf("\"%x\"", sha1.Sum(b))
+}
+
+// MatchEntityTag reports whether an If-Match header value matches etag, using
+// the strong comparison function: weak tags never match.
+func MatchEntityTag(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
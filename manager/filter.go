@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QueryError reports an invalid parameter of a read, such as a filter on a
+// field that cannot be filtered.
+type QueryError struct {
+	Param   string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s %s", e.Param, e.Message)
+}
+
+// filterCondition returns the WHERE condition matching a field against value
+// with the operator param ends with, if any. Without operator, * in value is a
+// wildcard and the collation of the column applies. Encrypted fields with a
+// blind index are matched on their exact value.
+func (em *EntityDbManager) filterCondition(entity string, param string, value string) (string, error) {
+	r := strings.NewReplacer("*", "%")
+	field, operator := splitOperator(param)
+
+	if bi, ok := em.blindIndexes[entity][field]; ok {
+		if (operator != "" && operator != "exact") || (operator == "" && strings.Contains(value, "*")) {
+			return "", &QueryError{param, "is encrypted and can only be filtered on exact values"}
+		}
+		return fmt.Sprintf("`%s` = '%s'", bi.column, bi.hash(value)), nil
+	}
+
+	expr, err := em.fieldExpression(entity, field)
+	if err != nil {
+		return "", err
+	}
+
+	if operator != "" {
+		return em.operatorCondition(expr, operator, value), nil
+	}
+
+	return fmt.Sprintf("%s LIKE %s", expr, em.Dialect.quoteString(r.Replace(value))), nil
+}
+
+// whereClause returns the WHERE clause of a read of entity filtered by
+// filterParams and options, including its search, or an empty string when
+// every row is read.
+func (em *EntityDbManager) whereClause(entity string, filterParams map[string]string, options *readOptions) (string, error) {
+	var conditions []string
+	for field, value := range filterParams {
+		condition, err := em.filterCondition(entity, field, value)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	conditions = append(conditions, em.whereConditions(entity, options)...)
+
+	if options.search != "" {
+		condition, _, err := em.searchCondition(entity, options.search)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if condition := em.softDeleteCondition(entity, options.deleted); condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("WHERE %s", strings.Join(conditions, " AND ")), nil
+}
+
+// whereConditions returns the WHERE conditions of the Where and RelatedTo
+// options.
+func (em *EntityDbManager) whereConditions(entity string, options *readOptions) []string {
+	var conditions []string
+	for _, w := range options.where {
+		conditions = append(conditions, fmt.Sprintf("`%s`.`%s` = %s", entity, w.field, em.convertJsonValue(w.value)))
+	}
+
+	for _, related := range options.relatedTo {
+		r := related.relationship
+		if r.Kind == ManyToMany {
+			conditions = append(conditions, em.linkedCondition(r, related.value))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("`%s`.`%s` = %s", entity, r.TargetColumn(), em.convertJsonValue(related.value)))
+		}
+	}
+
+	return conditions
+}
+
+// fieldExpression returns the SQL expression of a field of entity, which is
+// either a column or a virtual field computed by the database.
+func (em *EntityDbManager) fieldExpression(entity string, field string) (string, error) {
+	if vf, ok := em.virtualField(entity, field); ok {
+		if vf.Expr == "" {
+			return "", &QueryError{field, "is computed after the query and cannot be used to filter or sort"}
+		}
+		return fmt.Sprintf("(%s)", vf.Expr), nil
+	}
+
+	if _, ok := em.transformers[entity][field]; ok {
+		return "", &QueryError{field, "is transformed before being stored and cannot be used to filter or sort"}
+	}
+
+	return fmt.Sprintf("`%s`", field), nil
+}
@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// HookEvent is the point of an operation where a hook runs.
+type HookEvent int
+
+const (
+	BeforeCreate HookEvent = iota
+	AfterCreate
+	BeforeUpdate
+	AfterUpdate
+	BeforeDelete
+	AfterDelete
+	AfterRead
+)
+
+// HookContext describes the operation a hook runs for.
+type HookContext struct {
+	// Manager is bound to the transaction of the operation on writes, so
+	// hooks can read and write other entities atomically.
+	Manager *EntityDbManager
+	Entity  string
+	Id      string
+	// Data is the payload of a create or an update. Before hooks may modify it.
+	Data map[string]interface{}
+	// Row is the stored entity: the current one before an update or delete,
+	// the new one after a create or update, and the one being returned on
+	// read, which AfterRead hooks may modify.
+	Row map[string]interface{}
+}
+
+// Hook runs custom behaviour around an operation. Returning an error aborts
+// the operation and rolls its transaction back.
+type Hook func(hc *HookContext) error
+
+// HookError is returned by hooks to veto an operation. Status is the HTTP
+// status of the response, 422 Unprocessable Entity when left to zero.
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// HTTPStatus returns the HTTP status the veto is reported with.
+func (e *HookError) HTTPStatus() int {
+	if e.Status == 0 {
+		return http.StatusUnprocessableEntity
+	}
+	return e.Status
+}
+
+// AddHook registers a hook running on event for entity. Hooks run in the
+// order they were added.
+func (em *EntityDbManager) AddHook(entity string, event HookEvent, hook Hook) {
+	if em.hooks[entity] == nil {
+		em.hooks[entity] = map[HookEvent][]Hook{}
+	}
+	em.hooks[entity][event] = append(em.hooks[entity][event], hook)
+}
+
+// hasHooks reports whether any hook is registered on one of events for entity.
+func (em *EntityDbManager) hasHooks(entity string, events ...HookEvent) bool {
+	for _, event := range events {
+		if len(em.hooks[entity][event]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks runs the hooks registered on event for entity, stopping at the
+// first error.
+func (em *EntityDbManager) runHooks(event HookEvent, hc *HookContext) error {
+	for _, hook := range em.hooks[hc.Entity][event] {
+		if err := hook(hc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exec runs a statement on the transaction the manager is bound to, or on the
+// database. It is meant for hooks that need to write arbitrary data.
+func (em *EntityDbManager) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return em.conn().Exec(query, args...)
+}
@@ -0,0 +1,95 @@
+package manager
+
+import "time"
+
+// Query selects a page of entities: the ones matching Filters, sorted by
+// SortField in SortDir order, Limit of them after skipping Offset.
+type Query struct {
+	// Filters are the values the fields must match, with the syntax of the
+	// query string of GET /api/:entity, or the parameters of a named query.
+	Filters map[string]string
+	// SortField defaults to the id column of entities, and SortDir to ASC.
+	SortField string
+	SortDir   string
+	Limit     int
+	Offset    int
+	Options   []ReadOption
+}
+
+// EntityManager stores the entities served by the REST API. EntityDbManager
+// implements it on SQL databases. A manager may implement the other
+// interfaces of this file as well to serve the matching endpoints.
+type EntityManager interface {
+	GetIdColumn(entity string) string
+	// ListEntities returns the page of entities selected by query, with the
+	// total number of entities matching its filters.
+	ListEntities(entity string, query Query) ([]map[string]interface{}, int, error)
+	GetEntity(entity string, id string, opts ...ReadOption) (map[string]interface{}, error)
+	PostEntity(entity string, postData map[string]interface{}) (int64, error)
+	UpdateEntityIfMatch(entity string, id string, updateData map[string]interface{}, ifMatch string) (int64, map[string]interface{}, error)
+	DeleteEntityIfMatch(entity string, id string, ifMatch string) (int64, error)
+	EntityTag(entity string, row map[string]interface{}) string
+	LastModified(entity string, rows ...map[string]interface{}) (time.Time, bool)
+	ClassifyError(err error) error
+	// InTransaction runs fn with a manager whose changes are kept only when fn
+	// returns nil.
+	InTransaction(fn func(EntityManager) error) error
+}
+
+// Restorer restores soft deleted entities.
+type Restorer interface {
+	RestoreEntity(entity string, id string) (int64, error)
+}
+
+// EntityVerifier checks values against the stored fields of entities.
+type EntityVerifier interface {
+	VerifyEntity(entity string, id string, candidates map[string]interface{}) (verified bool, found bool, err error)
+}
+
+// Relater resolves the relationships of entities and links entities through
+// join tables.
+type Relater interface {
+	Relationship(entity string, name string) (Relationship, error)
+	Link(entity string, id string, name string, targetIds ...interface{}) (int64, error)
+	Unlink(entity string, id string, name string, targetIds ...interface{}) (int64, error)
+	SetLinks(entity string, id string, name string, targetIds ...interface{}) error
+}
+
+// Aggregator computes metrics and facets over entities.
+type Aggregator interface {
+	AggregateEntities(entity string, filterParams map[string]string, aggregation Aggregation, opts ...ReadOption) ([]map[string]interface{}, error)
+	FacetEntities(entity string, filterParams map[string]string, fields []string, opts ...ReadOption) (map[string][]map[string]interface{}, error)
+}
+
+// QueryRunner runs registered named queries.
+type QueryRunner interface {
+	RunQuery(name string, query Query) ([]map[string]interface{}, int, error)
+}
+
+// ProcedureCaller calls registered stored routines.
+type ProcedureCaller interface {
+	CallProcedure(name string, args interface{}) ([][]map[string]interface{}, error)
+}
+
+// ViewReporter reports which entities are read-only views.
+type ViewReporter interface {
+	IsView(entity string) (bool, error)
+}
+
+var (
+	_ EntityManager   = (*EntityDbManager)(nil)
+	_ Restorer        = (*EntityDbManager)(nil)
+	_ EntityVerifier  = (*EntityDbManager)(nil)
+	_ Relater         = (*EntityDbManager)(nil)
+	_ Aggregator      = (*EntityDbManager)(nil)
+	_ QueryRunner     = (*EntityDbManager)(nil)
+	_ ProcedureCaller = (*EntityDbManager)(nil)
+	_ ViewReporter    = (*EntityDbManager)(nil)
+)
+
+// InTransaction runs fn inside a single database transaction, see Transaction.
+func (em *EntityDbManager) InTransaction(fn func(EntityManager) error) error {
+	return em.Transaction(func(txm *EntityDbManager) error {
+		return fn(txm)
+	})
+}
@@ -0,0 +1,234 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// JoinTable relates two entities many-to-many: each of its rows links the
+// entity whose id is in Column to the target whose id is in TargetColumn.
+type JoinTable struct {
+	Table        string
+	Entity       string
+	Column       string
+	Target       string
+	TargetColumn string
+}
+
+// AddJoinTable declares a join table. It adds a ManyToMany relationship named
+// after the target to the entity, and one named after the entity to the
+// target.
+func (em *EntityDbManager) AddJoinTable(jt JoinTable) {
+	em.joinTables = append(em.joinTables, jt)
+}
+
+// manyToMany returns the ManyToMany relationships of entity. ForeignKey is the
+// foreign key of the join table referencing entity, and JoinKey the one
+// referencing the target.
+func (em *EntityDbManager) manyToMany(entity string) []Relationship {
+	var relationships []Relationship
+
+	for _, jt := range em.joinTables {
+		entityKey := ForeignKey{jt.Table, jt.Column, jt.Entity, em.GetIdColumn(jt.Entity)}
+		targetKey := ForeignKey{jt.Table, jt.TargetColumn, jt.Target, em.GetIdColumn(jt.Target)}
+
+		if strings.EqualFold(jt.Entity, entity) {
+			relationships = append(relationships, Relationship{
+				Name:       jt.Target,
+				Kind:       ManyToMany,
+				Entity:     entity,
+				Target:     jt.Target,
+				ForeignKey: entityKey,
+				JoinKey:    targetKey,
+			})
+		}
+
+		if strings.EqualFold(jt.Target, entity) {
+			relationships = append(relationships, Relationship{
+				Name:       jt.Entity,
+				Kind:       ManyToMany,
+				Entity:     entity,
+				Target:     jt.Entity,
+				ForeignKey: targetKey,
+				JoinKey:    entityKey,
+			})
+		}
+	}
+
+	return relationships
+}
+
+// linkedCondition returns the condition selecting the targets of r linked to
+// the entity whose id is value.
+func (em *EntityDbManager) linkedCondition(r Relationship, value interface{}) string {
+	return fmt.Sprintf(
+		"`%s`.`%s` IN (SELECT `%s` FROM `%s` WHERE `%s` = %s)",
+		r.Target,
+		r.TargetColumn(),
+		r.JoinKey.Column,
+		r.JoinKey.Entity,
+		r.ForeignKey.Column,
+		em.convertJsonValue(value),
+	)
+}
+
+// manyToManyRelationship returns the ManyToMany relationship name of entity.
+func (em *EntityDbManager) manyToManyRelationship(entity string, name string) (Relationship, error) {
+	r, err := em.Relationship(entity, name)
+	if err == nil && r.Kind != ManyToMany {
+		err = &QueryError{name, fmt.Sprintf("is not a many-to-many relationship of %s", entity)}
+	}
+	return r, err
+}
+
+// Link links the entity with the given id to targets of the ManyToMany
+// relationship name, and returns the number of new links. Existing links are
+// kept, and targets that do not exist are reported in a *ValidationError.
+func (em *EntityDbManager) Link(entity string, id string, name string, targetIds ...interface{}) (int64, error) {
+	r, err := em.manyToManyRelationship(entity, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var linked int64
+	err = em.Transaction(func(txm *EntityDbManager) error {
+		if err := txm.checkTargets(r, targetIds); err != nil {
+			return err
+		}
+
+		for _, targetId := range targetIds {
+			var count int
+			err := txm.conn().QueryRow(fmt.Sprintf(
+				"SELECT COUNT(*) FROM `%s` WHERE `%s` = %s AND `%s` = %s",
+				r.JoinKey.Entity,
+				r.ForeignKey.Column,
+				id,
+				r.JoinKey.Column,
+				txm.convertJsonValue(targetId),
+			)).Scan(&count)
+			if err != nil {
+				return err
+			} else if count > 0 {
+				continue
+			}
+
+			_, err = txm.conn().Exec(fmt.Sprintf(
+				"INSERT INTO `%s` (`%s`, `%s`) VALUES(%s, %s)",
+				r.JoinKey.Entity,
+				r.ForeignKey.Column,
+				r.JoinKey.Column,
+				id,
+				txm.convertJsonValue(targetId),
+			))
+			if err != nil {
+				return err
+			}
+			linked++
+		}
+
+		return nil
+	})
+
+	return linked, err
+}
+
+// Unlink removes the links between the entity with the given id and targets
+// of the ManyToMany relationship name, and returns the number of removed links.
+func (em *EntityDbManager) Unlink(entity string, id string, name string, targetIds ...interface{}) (int64, error) {
+	r, err := em.manyToManyRelationship(entity, name)
+	if err != nil || len(targetIds) == 0 {
+		return 0, err
+	}
+
+	values := make([]string, len(targetIds))
+	for i, targetId := range targetIds {
+		values[i] = em.convertJsonValue(targetId)
+	}
+
+	res, err := em.conn().Exec(fmt.Sprintf(
+		"DELETE FROM `%s` WHERE `%s` = %s AND `%s` IN (%s)",
+		r.JoinKey.Entity,
+		r.ForeignKey.Column,
+		id,
+		r.JoinKey.Column,
+		strings.Join(values, ", "),
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// SetLinks replaces the targets of the ManyToMany relationship name linked to
+// the entity with the given id by targets.
+func (em *EntityDbManager) SetLinks(entity string, id string, name string, targetIds ...interface{}) error {
+	r, err := em.manyToManyRelationship(entity, name)
+	if err != nil {
+		return err
+	}
+
+	return em.Transaction(func(txm *EntityDbManager) error {
+		if err := txm.checkTargets(r, targetIds); err != nil {
+			return err
+		}
+
+		_, err := txm.conn().Exec(fmt.Sprintf(
+			"DELETE FROM `%s` WHERE `%s` = %s",
+			r.JoinKey.Entity,
+			r.ForeignKey.Column,
+			id,
+		))
+		if err != nil {
+			return err
+		}
+
+		_, err = txm.Link(entity, id, name, targetIds...)
+		return err
+	})
+}
+
+// checkTargets returns a *ValidationError listing the targets of r that do not
+// exist, since SQLite does not enforce foreign keys by default.
+func (em *EntityDbManager) checkTargets(r Relationship, targetIds []interface{}) error {
+	if len(targetIds) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(targetIds))
+	for i, targetId := range targetIds {
+		values[i] = em.convertJsonValue(targetId)
+	}
+
+	whereClause := fmt.Sprintf("`%s` IN (%s)", r.TargetColumn(), strings.Join(values, ", "))
+	if condition := em.softDeleteCondition(r.Target, ExcludeDeleted); condition != "" {
+		whereClause = fmt.Sprintf("%s AND %s", whereClause, condition)
+	}
+
+	rows, err := em.retrieveAllResultsByQuery(fmt.Sprintf(
+		"SELECT `%s` FROM `%s` WHERE %s",
+		r.TargetColumn(),
+		r.Target,
+		whereClause,
+	))
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, row := range rows {
+		existing[fmt.Sprintf("%v", row[r.TargetColumn()])] = true
+	}
+
+	var fieldErrors []FieldError
+	for _, targetId := range targetIds {
+		if !existing[fmt.Sprintf("%v", targetId)] {
+			fieldErrors = append(fieldErrors, FieldError{r.TargetColumn(), fmt.Sprintf("%s %v does not exist", r.Target, targetId)})
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return &ValidationError{fieldErrors}
+	}
+	return nil
+}
@@ -0,0 +1,593 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryEntityManager keeps entities in memory instead of a database, e.g. for
+// tests and prototypes. Entities are declared with AddEntity or LoadFixtures,
+// accept any field, and get auto-incremented integer ids. Filters, sort and
+// pagination behave as with EntityDbManager on SQLite.
+type MemoryEntityManager struct {
+	EntityMap map[string]string
+
+	entities    *memoryEntities
+	foldAccents bool
+	// undo holds the changes to revert when the transaction the manager is
+	// bound to fails, and is nil outside transactions.
+	undo *[]func()
+}
+
+// memoryEntities holds the stores of the entities, all guarded by its lock,
+// which transactions hold until they end.
+type memoryEntities struct {
+	sync.RWMutex
+	stores map[string]*memoryStore
+}
+
+// memoryStore holds the rows of an entity by id.
+type memoryStore struct {
+	rows   map[int64]map[string]interface{}
+	nextId int64
+}
+
+func NewMemoryEntityManager() *MemoryEntityManager {
+	return NewMemoryEntityManagerWithEntityMap(map[string]string{})
+}
+
+func NewMemoryEntityManagerWithEntityMap(entityMap map[string]string) *MemoryEntityManager {
+	return &MemoryEntityManager{
+		EntityMap: entityMap,
+		entities:  &memoryEntities{stores: map[string]*memoryStore{}},
+	}
+}
+
+var _ EntityManager = (*MemoryEntityManager)(nil)
+
+// AddEntity declares entity, without any row. Declaring an existing entity
+// keeps its rows.
+func (m *MemoryEntityManager) AddEntity(entity string) {
+	defer m.lock()()
+
+	if _, ok := m.entities.stores[entity]; !ok {
+		m.entities.stores[entity] = &memoryStore{rows: map[int64]map[string]interface{}{}, nextId: 1}
+	}
+}
+
+// SetFoldAccents makes the case-insensitive filter operators ignore accents
+// as well.
+func (m *MemoryEntityManager) SetFoldAccents(enabled bool) {
+	m.foldAccents = enabled
+}
+
+// LoadFixtures adds the rows of a JSON file mapping entities to arrays of
+// rows, e.g. {"user": [{"id": 1, "username": "demo"}]}, to the entities.
+// Rows without id get the next one.
+func (m *MemoryEntityManager) LoadFixtures(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fixtures := map[string][]map[string]interface{}{}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return err
+	}
+
+	for entity, rows := range fixtures {
+		m.AddEntity(entity)
+
+		for _, row := range rows {
+			if _, err := m.PostEntity(entity, row); err != nil {
+				return fmt.Errorf("%s: %s", entity, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SaveFixtures writes every entity to a JSON file that LoadFixtures reads,
+// with rows ordered by id.
+func (m *MemoryEntityManager) SaveFixtures(path string) error {
+	fixtures := map[string][]map[string]interface{}{}
+
+	unlock := m.rlock()
+	for entity, store := range m.entities.stores {
+		fixtures[entity] = store.sortedRows()
+	}
+	unlock()
+
+	data, err := json.MarshalIndent(fixtures, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (m *MemoryEntityManager) GetIdColumn(entity string) string {
+	if v, ok := m.EntityMap[entity]; ok {
+		return v
+	}
+	return DefaultIdColumn
+}
+
+// ListEntities returns the page of entities selected by query, with the total
+// number of entities matching its filters. Searches and embeds are not
+// supported.
+func (m *MemoryEntityManager) ListEntities(entity string, query Query) ([]map[string]interface{}, int, error) {
+	options := newReadOptions(query.Options)
+
+	if options.search != "" {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_q", fmt.Sprintf("is not supported by %s", entity)}
+	} else if len(options.embeds) > 0 {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_embed", "is not supported in memory"}
+	} else if query.SortField == ScoreField {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_sort", "_score requires a _q search"}
+	}
+
+	orderBy, orderDir := query.SortField, strings.ToUpper(query.SortDir)
+	if orderBy == "" {
+		orderBy = m.GetIdColumn(entity)
+	}
+
+	if orderDir != "" && orderDir != "ASC" && orderDir != "DESC" {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_sortDir", "must be ASC or DESC"}
+	}
+
+	unlock := m.rlock()
+	store, err := m.store(entity)
+	if err != nil {
+		unlock()
+		return make([]map[string]interface{}, 0), 0, err
+	}
+
+	rows := store.sortedRows()
+	unlock()
+
+	// entities accept any field, so the known ones are those of their rows
+	fields := map[string]bool{m.GetIdColumn(entity): true}
+	for _, row := range rows {
+		for field := range row {
+			fields[field] = true
+		}
+	}
+
+	for param := range query.Filters {
+		if field, _ := splitOperator(param); !fields[field] {
+			return make([]map[string]interface{}, 0), 0, &QueryError{param, fmt.Sprintf("%s is not a field of %s", field, entity)}
+		}
+	}
+
+	if !fields[orderBy] {
+		return make([]map[string]interface{}, 0), 0, &QueryError{"_sort", fmt.Sprintf("%s is not a field of %s", orderBy, entity)}
+	}
+
+	matching := make([]map[string]interface{}, 0)
+	for _, row := range rows {
+		matches, err := m.matches(row, query.Filters, options)
+		if err != nil {
+			return make([]map[string]interface{}, 0), 0, err
+		} else if matches {
+			matching = append(matching, row)
+		}
+	}
+
+	// rows are sorted by id already, which breaks ties
+	sort.SliceStable(matching, func(i, j int) bool {
+		if orderDir == "DESC" {
+			return compareValues(matching[j][orderBy], matching[i][orderBy]) < 0
+		}
+		return compareValues(matching[i][orderBy], matching[j][orderBy]) < 0
+	})
+
+	page := make([]map[string]interface{}, 0)
+	for i := query.Offset; i >= 0 && i < len(matching) && i < query.Offset+query.Limit; i++ {
+		page = append(page, project(matching[i], options))
+	}
+
+	return page, len(matching), nil
+}
+
+func (m *MemoryEntityManager) GetEntity(entity string, id string, opts ...ReadOption) (map[string]interface{}, error) {
+	options := newReadOptions(opts)
+
+	unlock := m.rlock()
+	store, err := m.store(entity)
+	if err != nil {
+		unlock()
+		return make(map[string]interface{}), err
+	}
+
+	row, ok := store.row(id)
+	unlock()
+
+	if !ok {
+		return make(map[string]interface{}), nil
+	}
+
+	if matches, err := m.matches(row, nil, options); err != nil || !matches {
+		return make(map[string]interface{}), err
+	}
+
+	return project(row, options), nil
+}
+
+// PostEntity stores a copy of postData, with the next id of entity unless
+// it has one, and returns its id.
+func (m *MemoryEntityManager) PostEntity(entity string, postData map[string]interface{}) (int64, error) {
+	defer m.lock()()
+
+	store, err := m.store(entity)
+	if err != nil {
+		return 0, err
+	}
+
+	idColumn := m.GetIdColumn(entity)
+	row := copyData(postData)
+
+	var id int64
+	if value, ok := row[idColumn]; ok && value != nil {
+		if id, err = strconv.ParseInt(formatValue(value), 10, 64); err != nil {
+			return 0, &ValidationError{Fields: []FieldError{{idColumn, "must be an integer"}}}
+		} else if _, exists := store.rows[id]; exists {
+			return 0, &DbError{Kind: UniqueViolation, Field: idColumn, Err: fmt.Errorf("duplicate id %d of %s", id, entity)}
+		}
+	} else {
+		id = store.nextId
+	}
+
+	if id >= store.nextId {
+		store.nextId = id + 1
+	}
+
+	row[idColumn] = id
+	store.rows[id] = row
+
+	m.onRollback(func() {
+		delete(store.rows, id)
+	})
+
+	return id, nil
+}
+
+// UpdateEntityIfMatch updates the fields of updateData on the entity, except
+// its id, provided ifMatch matches its entity tag. An empty ifMatch always
+// matches.
+func (m *MemoryEntityManager) UpdateEntityIfMatch(entity string, id string, updateData map[string]interface{}, ifMatch string) (int64, map[string]interface{}, error) {
+	defer m.lock()()
+
+	store, err := m.store(entity)
+	if err != nil {
+		return 0, make(map[string]interface{}), err
+	}
+
+	row, ok := store.row(id)
+	if !ok {
+		return 0, make(map[string]interface{}), nil
+	} else if ifMatch != "" && !MatchEntityTag(ifMatch, m.EntityTag(entity, row)) {
+		return 0, make(map[string]interface{}), ErrPreconditionFailed
+	}
+
+	updated := copyData(row)
+	for field, value := range updateData {
+		if field != m.GetIdColumn(entity) {
+			updated[field] = value
+		}
+	}
+
+	// like SQL databases, the matched row is reported even if it is unchanged
+	if HashEntityTag(updated) == HashEntityTag(row) {
+		return 1, copyData(row), nil
+	}
+
+	rowId := row[m.GetIdColumn(entity)].(int64)
+	store.rows[rowId] = updated
+
+	m.onRollback(func() {
+		store.rows[rowId] = row
+	})
+
+	return 1, copyData(updated), nil
+}
+
+// DeleteEntityIfMatch deletes the entity provided ifMatch matches its entity
+// tag. An empty ifMatch always matches.
+func (m *MemoryEntityManager) DeleteEntityIfMatch(entity string, id string, ifMatch string) (int64, error) {
+	defer m.lock()()
+
+	store, err := m.store(entity)
+	if err != nil {
+		return 0, err
+	}
+
+	row, ok := store.row(id)
+	if !ok {
+		return 0, nil
+	} else if ifMatch != "" && !MatchEntityTag(ifMatch, m.EntityTag(entity, row)) {
+		return 0, ErrPreconditionFailed
+	}
+
+	rowId := row[m.GetIdColumn(entity)].(int64)
+	delete(store.rows, rowId)
+
+	m.onRollback(func() {
+		store.rows[rowId] = row
+	})
+
+	return 1, nil
+}
+
+func (m *MemoryEntityManager) EntityTag(entity string, row map[string]interface{}) string {
+	return HashEntityTag(row)
+}
+
+// LastModified always returns false, since rows have no modification time.
+func (m *MemoryEntityManager) LastModified(entity string, rows ...map[string]interface{}) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// ClassifyError returns err unchanged, since it never comes from a database.
+func (m *MemoryEntityManager) ClassifyError(err error) error {
+	return err
+}
+
+// InTransaction runs fn with a manager whose changes are reverted when fn
+// returns an error. The transaction locks every entity until fn returns, so
+// transactions run one at a time and other requests wait for them; fn must
+// only use the manager it is given. Ids are not reused after a rollback.
+// Calling InTransaction on a manager that is already bound to a transaction
+// reuses it.
+func (m *MemoryEntityManager) InTransaction(fn func(EntityManager) error) error {
+	if m.undo != nil {
+		return fn(m)
+	}
+
+	m.entities.Lock()
+	defer m.entities.Unlock()
+
+	txm := *m
+	txm.undo = &[]func(){}
+
+	if err := fn(&txm); err != nil {
+		for i := len(*txm.undo) - 1; i >= 0; i-- {
+			(*txm.undo)[i]()
+		}
+		return err
+	}
+
+	return nil
+}
+
+// onRollback registers undo to revert a change when the transaction the
+// manager is bound to fails.
+func (m *MemoryEntityManager) onRollback(undo func()) {
+	if m.undo != nil {
+		*m.undo = append(*m.undo, undo)
+	}
+}
+
+// lock locks the entities for writing and returns the function unlocking
+// them. A manager bound to a transaction holds the lock already.
+func (m *MemoryEntityManager) lock() func() {
+	if m.undo != nil {
+		return func() {}
+	}
+
+	m.entities.Lock()
+	return m.entities.Unlock
+}
+
+// rlock locks the entities for reading and returns the function unlocking
+// them.
+func (m *MemoryEntityManager) rlock() func() {
+	if m.undo != nil {
+		return func() {}
+	}
+
+	m.entities.RLock()
+	return m.entities.RUnlock
+}
+
+// store returns the store of entity. The entities must be locked.
+func (m *MemoryEntityManager) store(entity string) (*memoryStore, error) {
+	store, ok := m.entities.stores[entity]
+	if !ok {
+		return nil, &DbError{Kind: UnknownEntity, Err: fmt.Errorf("no such entity: %s", entity)}
+	}
+	return store, nil
+}
+
+// row returns the row with the given id. The entities must be locked.
+func (s *memoryStore) row(id string) (map[string]interface{}, bool) {
+	rowId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	row, ok := s.rows[rowId]
+	return row, ok
+}
+
+// sortedRows returns the rows of the store ordered by id. The entities must
+// be locked.
+func (s *memoryStore) sortedRows() []map[string]interface{} {
+	ids := make([]int64, 0, len(s.rows))
+	for id := range s.rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	rows := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		rows[i] = s.rows[id]
+	}
+	return rows
+}
+
+// matches reports whether row matches the filters and the Where options.
+func (m *MemoryEntityManager) matches(row map[string]interface{}, filters map[string]string, options *readOptions) (bool, error) {
+	if len(options.relatedTo) > 0 {
+		return false, &NotSupportedError{"relationships"}
+	}
+
+	for _, w := range options.where {
+		if value, ok := row[w.field]; !ok || formatValue(value) != formatValue(w.value) {
+			return false, nil
+		}
+	}
+
+	for param, filter := range filters {
+		field, operator := splitOperator(param)
+
+		value, ok := row[field]
+		if !ok || value == nil {
+			return false, nil
+		}
+
+		if !m.matchFilter(formatValue(value), operator, filter) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// matchFilter matches value against filter with a filter operator, like the
+// conditions of EntityDbManager.
+func (m *MemoryEntityManager) matchFilter(value string, operator string, filter string) bool {
+	// without operator, the filter is a LIKE pattern where * stands for %
+	if operator == "" {
+		return likePattern(strings.Replace(filter, "*", "%", -1)).MatchString(value)
+	}
+
+	if strings.HasPrefix(operator, "i") {
+		value, filter = m.fold(value), m.fold(filter)
+	}
+
+	switch strings.TrimPrefix(operator, "i") {
+	case "contains":
+		return strings.Contains(value, filter)
+	case "startswith":
+		return strings.HasPrefix(value, filter)
+	case "endswith":
+		return strings.HasSuffix(value, filter)
+	case "like":
+		parts := strings.Split(filter, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		return regexp.MustCompile("^(?s)" + strings.Join(parts, ".*") + "$").MatchString(value)
+	}
+	return value == filter
+}
+
+// likePattern returns the regular expression of a LIKE pattern, which ignores
+// the case of ASCII letters like SQLite.
+func likePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^(?s)")
+	for _, c := range pattern {
+		switch {
+		case c == '%':
+			expr.WriteString(".*")
+		case c == '_':
+			expr.WriteString(".")
+		case c < 128 && strings.ToLower(string(c)) != strings.ToUpper(string(c)):
+			fmt.Fprintf(&expr, "[%s%s]", strings.ToLower(string(c)), strings.ToUpper(string(c)))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// fold returns s with case, and accents if enabled, folded.
+func (m *MemoryEntityManager) fold(s string) string {
+	s = strings.ToLower(s)
+	if !m.foldAccents {
+		return s
+	}
+
+	return strings.Map(func(r rune) rune {
+		for _, accent := range accents {
+			if strings.ContainsRune(accent.letters, r) {
+				return []rune(accent.base)[0]
+			}
+		}
+		return r
+	}, s)
+}
+
+// project returns a copy of row restricted to the Fields option.
+func project(row map[string]interface{}, options *readOptions) map[string]interface{} {
+	if len(options.fields) == 0 || options.fields["*"] {
+		return copyData(row)
+	}
+
+	projected := make(map[string]interface{})
+	for field := range options.fields {
+		if value, ok := row[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// formatValue formats a JSON value the way it is compared in SQL, where
+// booleans are stored as 1 and 0.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// compareValues orders values like SQL: nulls first, then numbers by value,
+// then strings.
+func compareValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+
+	x, xErr := strconv.ParseFloat(formatValue(a), 64)
+	y, yErr := strconv.ParseFloat(formatValue(b), 64)
+	switch {
+	case xErr == nil && yErr == nil:
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case xErr == nil:
+		return -1
+	case yErr == nil:
+		return 1
+	}
+	return strings.Compare(formatValue(a), formatValue(b))
+}
@@ -0,0 +1,194 @@
+package manager
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnknownQuery is returned when running a query that was not registered.
+var ErrUnknownQuery = newManagerError("unknown query")
+
+var columnNamePattern = regexp.MustCompile(`^\w+$`)
+
+// ParamType is the type a query parameter is converted to before being bound.
+type ParamType int
+
+const (
+	StringParam ParamType = iota
+	IntegerParam
+	FloatParam
+	BooleanParam
+	// TimeParam is an RFC 3339 time.
+	TimeParam
+)
+
+// QueryParam declares the type of a parameter of a registered query.
+// Parameters that are not declared are bound as strings.
+type QueryParam struct {
+	Name string
+	Type ParamType
+}
+
+type namedQuery struct {
+	sql    string
+	params []string
+	types  map[string]ParamType
+}
+
+// RegisterQuery registers a query that can be run by name with RunQuery. Its
+// parameters are written :name in query, outside of string literals, and are
+// bound by the driver, so their values never change the SQL text.
+func (em *EntityDbManager) RegisterQuery(name string, query string, params ...QueryParam) {
+	nq := namedQuery{types: map[string]ParamType{}}
+	nq.sql, nq.params = em.bindParams(query)
+
+	for _, param := range params {
+		nq.types[param.Name] = param.Type
+	}
+
+	em.queries[name] = nq
+}
+
+// RunQuery runs the registered query name with the parameter values of the
+// filters of query, and returns the page of its rows selected by query, with
+// the total number of rows. Rows are only sorted when SortField is set, and of
+// the read options, only Fields applies, to the columns of the query.
+func (em *EntityDbManager) RunQuery(name string, query Query) ([]map[string]interface{}, int, error) {
+	params, orderBy, orderDir := query.Filters, query.SortField, query.SortDir
+
+	nq, ok := em.queries[name]
+	if !ok {
+		return make([]map[string]interface{}, 0), 0, ErrUnknownQuery
+	}
+
+	for param := range params {
+		if _, ok := nq.types[param]; !ok && !containsString(nq.params, param) {
+			return make([]map[string]interface{}, 0), 0, &QueryError{param, fmt.Sprintf("is not a parameter of %s", name)}
+		}
+	}
+
+	args := make([]interface{}, len(nq.params))
+	for i, param := range nq.params {
+		value, ok := params[param]
+		if !ok {
+			return make([]map[string]interface{}, 0), 0, &QueryError{param, "is required"}
+		}
+
+		var err error
+		if args[i], err = convertParam(param, nq.types[param], value); err != nil {
+			return make([]map[string]interface{}, 0), 0, err
+		}
+	}
+
+	columns := "*"
+	if options := newReadOptions(query.Options); len(options.fields) > 0 && !options.fields["*"] {
+		var fields []string
+		for field := range options.fields {
+			if !columnNamePattern.MatchString(field) {
+				return make([]map[string]interface{}, 0), 0, &QueryError{"_fields", fmt.Sprintf("%s is not a column name", field)}
+			}
+			fields = append(fields, em.Dialect.quoteIdentifier(field))
+		}
+		sort.Strings(fields)
+		columns = strings.Join(fields, ", ")
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM (%s) AS q", columns, nq.sql)
+
+	if orderBy != "" {
+		if !columnNamePattern.MatchString(orderBy) {
+			return make([]map[string]interface{}, 0), 0, &QueryError{"_sortField", "is not a column name"}
+		}
+
+		if orderDir = strings.ToUpper(orderDir); orderDir == "" {
+			orderDir = "ASC"
+		} else if orderDir != "ASC" && orderDir != "DESC" {
+			return make([]map[string]interface{}, 0), 0, &QueryError{"_sortDir", "must be ASC or DESC"}
+		}
+
+		sql = fmt.Sprintf("%s ORDER BY %s %s", sql, em.Dialect.quoteIdentifier(orderBy), orderDir)
+	}
+
+	allResults, err := em.retrieveAllResultsByQuery(fmt.Sprintf("%s LIMIT %d OFFSET %d", sql, query.Limit, query.Offset), args...)
+	if err != nil {
+		return make([]map[string]interface{}, 0), 0, err
+	}
+
+	var count int
+	if err := em.conn().QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS q", nq.sql), args...).Scan(&count); err != nil {
+		return make([]map[string]interface{}, 0), 0, err
+	}
+
+	return allResults, count, nil
+}
+
+// bindParams replaces the :name parameters of query by the placeholders of
+// the dialect, and returns them in order. Postgres casts such as ::int are
+// left untouched.
+func (em *EntityDbManager) bindParams(query string) (string, []string) {
+	var sql strings.Builder
+	var params []string
+	quoted := false
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			quoted = !quoted
+		}
+
+		if c != ':' || quoted || i+1 >= len(query) || !isWordChar(query[i+1]) || (i > 0 && query[i-1] == ':') {
+			sql.WriteByte(c)
+			continue
+		}
+
+		end := i + 1
+		for end < len(query) && isWordChar(query[end]) {
+			end++
+		}
+
+		params = append(params, query[i+1:end])
+		if em.Dialect == Postgres {
+			fmt.Fprintf(&sql, "$%d", len(params))
+		} else {
+			sql.WriteByte('?')
+		}
+		i = end - 1
+	}
+
+	return sql.String(), params
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// convertParam converts the value of a query parameter to its type.
+func convertParam(name string, paramType ParamType, value string) (interface{}, error) {
+	switch paramType {
+	case IntegerParam:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i, nil
+		}
+		return nil, &QueryError{name, "must be an integer"}
+	case FloatParam:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f, nil
+		}
+		return nil, &QueryError{name, "must be a number"}
+	case BooleanParam:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b, nil
+		}
+		return nil, &QueryError{name, "must be a boolean"}
+	case TimeParam:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		return nil, &QueryError{name, "must be an RFC 3339 time"}
+	}
+	return value, nil
+}
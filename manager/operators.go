@@ -0,0 +1,166 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// filterOperators are the operators a filter parameter may end with after a
+// double underscore, e.g. name__icontains=ann. The ones starting with i
+// ignore case, and accents when SetFoldAccents is enabled. like and ilike
+// take * as wildcard, the other ones match their value literally.
+var filterOperators = map[string]bool{
+	"exact":       true,
+	"iexact":      true,
+	"contains":    true,
+	"icontains":   true,
+	"startswith":  true,
+	"istartswith": true,
+	"endswith":    true,
+	"iendswith":   true,
+	"like":        true,
+	"ilike":       true,
+}
+
+var (
+	likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	globEscaper = strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]")
+)
+
+// accents are the accented Latin-1 letters of each base letter. SQLite has no
+// collation ignoring them, so its letters are matched against their variants.
+var accents = []struct {
+	letters string
+	base    string
+}{
+	{"àáâãäåÀÁÂÃÄÅ", "a"},
+	{"çÇ", "c"},
+	{"èéêëÈÉÊË", "e"},
+	{"ìíîïÌÍÎÏ", "i"},
+	{"ñÑ", "n"},
+	{"òóôõöøÒÓÔÕÖØ", "o"},
+	{"ùúûüÙÚÛÜ", "u"},
+	{"ýÿÝ", "y"},
+}
+
+// SetFoldAccents makes the case-insensitive filter operators ignore accents
+// as well. On Postgres, it requires the unaccent extension, and on MySQL, a
+// utf8mb4 column.
+func (em *EntityDbManager) SetFoldAccents(enabled bool) {
+	em.foldAccents = enabled
+}
+
+// splitOperator splits a filter parameter into its field and operator. The
+// operator is empty when the parameter does not end with a known one.
+func splitOperator(param string) (string, string) {
+	if i := strings.LastIndex(param, "__"); i > 0 && filterOperators[param[i+2:]] {
+		return param[:i], param[i+2:]
+	}
+	return param, ""
+}
+
+// operatorCondition returns the WHERE condition matching the SQL expression
+// expr against value with a filter operator. Conditions behave the same on
+// every dialect, whatever the collation of the column.
+func (em *EntityDbManager) operatorCondition(expr string, operator string, value string) string {
+	insensitive := strings.HasPrefix(operator, "i")
+	operator = strings.TrimPrefix(operator, "i")
+
+	leading := operator == "contains" || operator == "endswith"
+	trailing := operator == "contains" || operator == "startswith"
+	wildcards := operator == "like"
+
+	// SQLite LIKE only ignores the case of ASCII letters, so GLOB is used
+	// instead, matching letters against their variants to ignore case
+	if em.Dialect == SQLite {
+		escape := globEscaper.Replace
+		if insensitive {
+			escape = em.letterClasses
+		}
+		return fmt.Sprintf("%s GLOB %s", expr, em.Dialect.quoteString(matchPattern(value, leading, trailing, wildcards, escape, "*")))
+	}
+
+	if operator == "exact" {
+		switch {
+		case insensitive:
+			return fmt.Sprintf("%s = %s", em.fold(expr), em.fold(em.Dialect.quoteString(value)))
+		case em.Dialect == MySQL:
+			return fmt.Sprintf("%s = BINARY %s", expr, em.Dialect.quoteString(value))
+		}
+		return fmt.Sprintf("%s = %s", expr, em.Dialect.quoteString(value))
+	}
+
+	pattern := em.Dialect.quoteString(matchPattern(value, leading, trailing, wildcards, likeEscaper.Replace, "%"))
+	switch {
+	case insensitive:
+		return fmt.Sprintf("%s LIKE %s ESCAPE '!'", em.fold(expr), em.fold(pattern))
+	case em.Dialect == MySQL:
+		return fmt.Sprintf("%s LIKE BINARY %s ESCAPE '!'", expr, pattern)
+	}
+	return fmt.Sprintf("%s LIKE %s ESCAPE '!'", expr, pattern)
+}
+
+// matchPattern returns a LIKE or GLOB pattern matching value, preceded and
+// followed by anything when leading and trailing are set, and where * stands
+// for anything when wildcards is set. Every other character is escaped.
+func matchPattern(value string, leading bool, trailing bool, wildcards bool, escape func(string) string, wildcard string) string {
+	parts := []string{value}
+	if wildcards {
+		parts = strings.Split(value, "*")
+	}
+
+	for i, part := range parts {
+		parts[i] = escape(part)
+	}
+
+	pattern := strings.Join(parts, wildcard)
+	if leading {
+		pattern = wildcard + pattern
+	}
+	if trailing {
+		pattern = pattern + wildcard
+	}
+	return pattern
+}
+
+// fold returns the SQL expression of expr with case, and accents if enabled,
+// folded.
+func (em *EntityDbManager) fold(expr string) string {
+	switch {
+	case em.foldAccents && em.Dialect == Postgres:
+		return fmt.Sprintf("LOWER(unaccent(%s))", expr)
+	case em.foldAccents && em.Dialect == MySQL:
+		return fmt.Sprintf("LOWER(%s) COLLATE utf8mb4_unicode_ci", expr)
+	}
+	return fmt.Sprintf("LOWER(%s)", expr)
+}
+
+// letterClasses escapes s for GLOB, replacing every letter by the class of
+// its lowercase and uppercase variants, and accented ones if enabled, e.g.
+// [cCçÇ] for c.
+func (em *EntityDbManager) letterClasses(s string) string {
+	var classes []string
+	for _, letter := range s {
+		base := unicode.ToLower(letter)
+		for _, accent := range accents {
+			if em.foldAccents && strings.ContainsRune(accent.letters, letter) {
+				base = []rune(accent.base)[0]
+			}
+		}
+
+		variants := string([]rune{base, unicode.ToUpper(base)})
+		if base == unicode.ToUpper(base) {
+			classes = append(classes, globEscaper.Replace(string(letter)))
+			continue
+		}
+
+		for _, accent := range accents {
+			if em.foldAccents && accent.base == string(base) {
+				variants += accent.letters
+			}
+		}
+		classes = append(classes, fmt.Sprintf("[%s]", variants))
+	}
+	return strings.Join(classes, "")
+}
@@ -0,0 +1,241 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownProcedure is returned when calling a procedure that was not
+// registered.
+var ErrUnknownProcedure = newManagerError("unknown procedure")
+
+// ErrProceduresNotSupported is returned when calling a procedure on a database
+// without stored routines, such as SQLite.
+var ErrProceduresNotSupported = newManagerError("stored procedures are not supported by this database")
+
+// RoutineKind tells how a registered routine is called.
+type RoutineKind int
+
+const (
+	// StoredProcedure is called with CALL, and returns its result sets.
+	StoredProcedure RoutineKind = iota
+	// StoredFunction is selected from, and returns its value, or its rows on
+	// Postgres when it returns a set.
+	StoredFunction
+)
+
+// Procedure declares a stored routine that may be called with CallProcedure.
+type Procedure struct {
+	Kind RoutineKind
+	// Routine is the SQL name of the routine, and defaults to the name it is
+	// registered under.
+	Routine string
+	// Params are the names of the input parameters of the routine, in order.
+	// They are read from the database on MySQL and Postgres when not set.
+	Params []string
+}
+
+// RegisterProcedure allows the stored routine procedure to be called as name.
+// Routines that are not registered cannot be called.
+func (em *EntityDbManager) RegisterProcedure(name string, procedure Procedure) {
+	if procedure.Routine == "" {
+		procedure.Routine = name
+	}
+	em.procedures[name] = procedure
+}
+
+// CallProcedure calls the routine registered as name with args, either a
+// slice of values bound in order or a map of values bound by parameter name,
+// and returns its result sets.
+func (em *EntityDbManager) CallProcedure(name string, args interface{}) ([][]map[string]interface{}, error) {
+	procedure, ok := em.procedures[name]
+	if !ok {
+		return nil, ErrUnknownProcedure
+	}
+
+	if em.Dialect == SQLite {
+		return nil, ErrProceduresNotSupported
+	}
+
+	values, err := em.procedureArgs(procedure, args)
+	if err != nil {
+		return nil, err
+	}
+
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = "?"
+		if em.Dialect == Postgres {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		}
+	}
+
+	query := fmt.Sprintf("CALL %s(%s)", procedure.Routine, strings.Join(placeholders, ", "))
+	if procedure.Kind == StoredFunction && em.Dialect == Postgres {
+		query = fmt.Sprintf("SELECT * FROM %s(%s)", procedure.Routine, strings.Join(placeholders, ", "))
+	} else if procedure.Kind == StoredFunction {
+		query = fmt.Sprintf("SELECT %s(%s) AS `result`", procedure.Routine, strings.Join(placeholders, ", "))
+	}
+
+	rows, err := em.conn().Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resultSets := make([][]map[string]interface{}, 0)
+	for {
+		// the columns are read first, since the rows are closed once the last
+		// result set is scanned
+		columns, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+
+		results, err := em.scanRows(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		// a MySQL procedure ends with a result set holding its status only
+		if len(columns) > 0 {
+			resultSets = append(resultSets, results)
+		}
+
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+
+	return resultSets, rows.Err()
+}
+
+// procedureArgs returns the values of args in the order of the parameters of
+// procedure.
+func (em *EntityDbManager) procedureArgs(procedure Procedure, args interface{}) ([]interface{}, error) {
+	params, err := em.procedureParams(procedure)
+	if err != nil {
+		return nil, err
+	}
+
+	if args == nil {
+		args = []interface{}{}
+	}
+
+	switch args := args.(type) {
+	case []interface{}:
+		if params != nil && len(args) > len(params) {
+			return nil, &QueryError{"args", fmt.Sprintf("must have at most %d values", len(params))}
+		}
+
+		for i, arg := range args {
+			if !isScalar(arg) {
+				return nil, &QueryError{fmt.Sprintf("args[%d]", i), "must be a scalar value"}
+			}
+		}
+		return args, nil
+	case map[string]interface{}:
+		if params == nil {
+			return nil, &QueryError{"args", "must be an array since the parameters are unknown"}
+		}
+
+		for arg := range args {
+			if !containsString(params, arg) {
+				return nil, &QueryError{arg, fmt.Sprintf("is not a parameter of %s", procedure.Routine)}
+			}
+		}
+
+		values := make([]interface{}, len(params))
+		for i, param := range params {
+			arg, ok := args[param]
+			if !ok {
+				return nil, &QueryError{param, "is required"}
+			}
+			if !isScalar(arg) {
+				return nil, &QueryError{param, "must be a scalar value"}
+			}
+			values[i] = arg
+		}
+		return values, nil
+	}
+
+	return nil, &QueryError{"args", "must be an array or an object"}
+}
+
+// procedureParams returns the names of the input parameters of procedure, or
+// nil when they are unknown. They are read from the database the first time
+// and cached afterwards. MySQL routines with OUT or INOUT parameters are
+// rejected, since their output can only be read from session variables.
+func (em *EntityDbManager) procedureParams(procedure Procedure) ([]string, error) {
+	if procedure.Params != nil {
+		return procedure.Params, nil
+	}
+
+	em.schema.RLock()
+	params, ok := em.schema.procedureParams[procedure.Routine]
+	em.schema.RUnlock()
+
+	if ok {
+		return params, nil
+	}
+
+	var query string
+	switch em.Dialect {
+	case Postgres:
+		query = fmt.Sprintf(
+			"SELECT p.parameter_name, p.parameter_mode FROM information_schema.parameters p "+
+				"JOIN information_schema.routines r ON r.specific_schema = p.specific_schema AND r.specific_name = p.specific_name "+
+				"WHERE r.routine_schema = current_schema() AND r.routine_name = %s AND p.parameter_mode IN ('IN', 'INOUT', 'OUT') "+
+				"ORDER BY p.ordinal_position",
+			em.Dialect.quoteString(procedure.Routine),
+		)
+	case MySQL:
+		query = fmt.Sprintf(
+			"SELECT PARAMETER_NAME AS parameter_name, PARAMETER_MODE AS parameter_mode FROM information_schema.PARAMETERS "+
+				"WHERE SPECIFIC_SCHEMA = DATABASE() AND SPECIFIC_NAME = %s AND PARAMETER_MODE IN ('IN', 'INOUT', 'OUT') "+
+				"ORDER BY ORDINAL_POSITION",
+			em.Dialect.quoteString(procedure.Routine),
+		)
+	default:
+		return nil, nil
+	}
+
+	rows, err := em.retrieveAllResultsByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	params = make([]string, 0, len(rows))
+	for _, row := range rows {
+		switch mode := fmt.Sprintf("%v", row["parameter_mode"]); {
+		case mode != "IN" && em.Dialect == MySQL:
+			return nil, &NotSupportedError{"OUT and INOUT parameters of MySQL routines"}
+		case mode != "OUT":
+			params = append(params, fmt.Sprintf("%v", row["parameter_name"]))
+		}
+	}
+
+	em.schema.Lock()
+	em.schema.procedureParams[procedure.Routine] = params
+	em.schema.Unlock()
+
+	return params, nil
+}
+
+// isScalar reports whether a decoded JSON value can be bound to a parameter.
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, bool, float64, string:
+		return true
+	}
+	return false
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
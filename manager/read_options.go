@@ -0,0 +1,133 @@
+package manager
+
+import "strings"
+
+// ReadOption customizes the rows returned by GetEntities and GetEntity.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	deleted   DeletedScope
+	fields    map[string]bool
+	embeds    []string
+	where     []fieldValue
+	relatedTo []relatedValue
+	search    string
+	// locked rows stay locked until the end of the transaction, on the
+	// dialects with row locks
+	locked bool
+}
+
+type relatedValue struct {
+	relationship Relationship
+	value        interface{}
+}
+
+type fieldValue struct {
+	field string
+	value interface{}
+}
+
+func newReadOptions(opts []ReadOption) *readOptions {
+	options := &readOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// Deleted selects whether soft deleted rows are returned.
+func Deleted(scope DeletedScope) ReadOption {
+	return func(o *readOptions) {
+		o.deleted = scope
+	}
+}
+
+// Fields restricts the fields of the returned rows, and opts in to the virtual
+// fields of the entity. "*" stands for every column of the table, and a dotted
+// field such as author.username selects a field of an embedded entity.
+func Fields(fields ...string) ReadOption {
+	return func(o *readOptions) {
+		for _, field := range fields {
+			if o.fields == nil {
+				o.fields = map[string]bool{}
+			}
+			o.fields[field] = true
+		}
+	}
+}
+
+// Where restricts the rows to the ones whose field equals value, e.g. the
+// children of a parent entity.
+func Where(field string, value interface{}) ReadOption {
+	return func(o *readOptions) {
+		o.where = append(o.where, fieldValue{field, value})
+	}
+}
+
+// RelatedTo restricts the rows to the targets of r related to the entity whose
+// LocalColumn is value, e.g. the tags of a post.
+func RelatedTo(r Relationship, value interface{}) ReadOption {
+	return func(o *readOptions) {
+		o.relatedTo = append(o.relatedTo, relatedValue{r, value})
+	}
+}
+
+// Search restricts the rows to the ones matching a full-text search of query
+// over the columns configured with SetSearchIndex.
+func Search(query string) ReadOption {
+	return func(o *readOptions) {
+		o.search = query
+	}
+}
+
+// Embed embeds the related entities of the returned rows, following the
+// relationships named by paths. A dotted path such as comment.user embeds the
+// relationships of the embedded entities as well.
+func Embed(paths ...string) ReadOption {
+	return func(o *readOptions) {
+		o.embeds = append(o.embeds, paths...)
+	}
+}
+
+// wantsField reports whether a virtual field was requested.
+func (o *readOptions) wantsField(field string) bool {
+	return o.fields[field]
+}
+
+// projection returns the fields of the returned rows, or nil when every field
+// is returned.
+func (o *readOptions) projection() map[string]bool {
+	var fields map[string]bool
+	for field := range o.fields {
+		if field == "*" {
+			return nil
+		} else if !strings.Contains(field, ".") {
+			if fields == nil {
+				fields = map[string]bool{}
+			}
+			fields[field] = true
+		}
+	}
+	return fields
+}
+
+// related returns the options of the entities embedded through the
+// relationship name: the fields and paths below name.
+func (o *readOptions) related(name string) *readOptions {
+	related := &readOptions{deleted: ExcludeDeleted}
+	prefix := name + "."
+
+	for field := range o.fields {
+		if strings.HasPrefix(field, prefix) {
+			Fields(field[len(prefix):])(related)
+		}
+	}
+
+	for _, path := range o.embeds {
+		if strings.HasPrefix(path, prefix) {
+			related.embeds = append(related.embeds, path[len(prefix):])
+		}
+	}
+
+	return related
+}
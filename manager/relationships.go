@@ -0,0 +1,224 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ForeignKey is a column of an entity referencing a column of another one.
+type ForeignKey struct {
+	Entity           string
+	Column           string
+	References       string
+	ReferencedColumn string
+}
+
+// RelationshipKind is the cardinality of a relationship.
+type RelationshipKind int
+
+const (
+	// ManyToOne relates an entity to the one its foreign key references, e.g.
+	// a post to its author.
+	ManyToOne RelationshipKind = iota
+	// OneToMany relates an entity to the ones referencing it, e.g. a post to
+	// its comments.
+	OneToMany
+	// ManyToMany relates an entity to others through a join table, e.g. a
+	// post to its tags.
+	ManyToMany
+)
+
+// Relationship is an edge of the relationship graph, going from Entity to
+// Target through ForeignKey.
+type Relationship struct {
+	// Name identifies the relationship from Entity: the foreign key column
+	// without its _id suffix for ManyToOne, e.g. author for author_id, or
+	// else the name of Target.
+	Name       string
+	Kind       RelationshipKind
+	Entity     string
+	Target     string
+	ForeignKey ForeignKey
+	// JoinKey is, for ManyToMany relationships, the foreign key of the join
+	// table referencing Target. ForeignKey is then the one referencing Entity.
+	JoinKey ForeignKey
+}
+
+// LocalColumn returns the column of Entity the relationship joins on.
+func (r Relationship) LocalColumn() string {
+	if r.Kind == ManyToOne {
+		return r.ForeignKey.Column
+	}
+	return r.ForeignKey.ReferencedColumn
+}
+
+// TargetColumn returns the column of Target the relationship joins on.
+func (r Relationship) TargetColumn() string {
+	switch r.Kind {
+	case ManyToOne:
+		return r.ForeignKey.ReferencedColumn
+	case ManyToMany:
+		return r.JoinKey.ReferencedColumn
+	}
+	return r.ForeignKey.Column
+}
+
+// AddForeignKey declares a foreign key the database does not know about, e.g.
+// on MyISAM tables or views. It replaces any discovered foreign key on the
+// same column.
+func (em *EntityDbManager) AddForeignKey(fk ForeignKey) {
+	em.foreignKeys = append(em.foreignKeys, fk)
+}
+
+// ForeignKeys returns every foreign key of the database, followed by the
+// declared ones. They are read from the database the first time and cached
+// afterwards.
+func (em *EntityDbManager) ForeignKeys() ([]ForeignKey, error) {
+	em.schema.RLock()
+	discovered, ok := em.schema.foreignKeys, em.schema.foreignKeysRead
+	em.schema.RUnlock()
+
+	if !ok {
+		var err error
+		if discovered, err = em.readForeignKeys(); err != nil {
+			return nil, err
+		}
+
+		em.schema.Lock()
+		em.schema.foreignKeys, em.schema.foreignKeysRead = discovered, true
+		em.schema.Unlock()
+	}
+
+	var foreignKeys []ForeignKey
+	for _, fk := range discovered {
+		declared := false
+		for _, d := range em.foreignKeys {
+			declared = declared || (strings.EqualFold(d.Entity, fk.Entity) && strings.EqualFold(d.Column, fk.Column))
+		}
+		if !declared {
+			foreignKeys = append(foreignKeys, fk)
+		}
+	}
+
+	return append(foreignKeys, em.foreignKeys...), nil
+}
+
+// Relationships returns the relationships of entity: one ManyToOne per foreign
+// key of entity, one OneToMany per foreign key referencing it, and one
+// ManyToMany per join table. Entity names are compared case-insensitively, as
+// table names usually are.
+func (em *EntityDbManager) Relationships(entity string) ([]Relationship, error) {
+	foreignKeys, err := em.ForeignKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var relationships []Relationship
+	for _, fk := range foreignKeys {
+		if strings.EqualFold(fk.Entity, entity) {
+			name := strings.TrimSuffix(fk.Column, "_id")
+			if name == fk.Column || name == "" {
+				name = fk.References
+			}
+
+			relationships = append(relationships, Relationship{
+				Name:       name,
+				Kind:       ManyToOne,
+				Entity:     entity,
+				Target:     fk.References,
+				ForeignKey: fk,
+			})
+		}
+
+		if strings.EqualFold(fk.References, entity) {
+			relationships = append(relationships, Relationship{
+				Name:       fk.Entity,
+				Kind:       OneToMany,
+				Entity:     entity,
+				Target:     fk.Entity,
+				ForeignKey: fk,
+			})
+		}
+	}
+
+	relationships = append(relationships, em.manyToMany(entity)...)
+
+	sort.SliceStable(relationships, func(i, j int) bool {
+		return relationships[i].Name < relationships[j].Name
+	})
+
+	return relationships, nil
+}
+
+// Relationship returns the relationship of entity with the given name, or a
+// *QueryError if there is none.
+func (em *EntityDbManager) Relationship(entity string, name string) (Relationship, error) {
+	relationships, err := em.Relationships(entity)
+	if err != nil {
+		return Relationship{}, err
+	}
+
+	for _, r := range relationships {
+		if strings.EqualFold(r.Name, name) {
+			return r, nil
+		}
+	}
+
+	return Relationship{}, &QueryError{name, fmt.Sprintf("is not a relationship of %s", entity)}
+}
+
+func (em *EntityDbManager) readForeignKeys() ([]ForeignKey, error) {
+	var query string
+
+	switch em.Dialect {
+	case SQLite:
+		query = "SELECT m.name AS entity, p.`from` AS col, p.`table` AS ref, p.`to` AS ref_col " +
+			"FROM sqlite_master m JOIN pragma_foreign_key_list(m.name) p " +
+			"WHERE m.type = 'table' ORDER BY m.name, p.id, p.seq"
+	case Postgres:
+		query = "SELECT kcu.table_name AS entity, kcu.column_name AS col, ccu.table_name AS ref, ccu.column_name AS ref_col " +
+			"FROM information_schema.table_constraints tc " +
+			"JOIN information_schema.key_column_usage kcu " +
+			"ON kcu.constraint_name = tc.constraint_name AND kcu.table_schema = tc.table_schema " +
+			"JOIN information_schema.constraint_column_usage ccu " +
+			"ON ccu.constraint_name = tc.constraint_name AND ccu.table_schema = tc.table_schema " +
+			"WHERE tc.constraint_type = 'FOREIGN KEY' AND tc.table_schema = current_schema() " +
+			"ORDER BY kcu.table_name, kcu.ordinal_position"
+	default:
+		query = "SELECT TABLE_NAME AS entity, COLUMN_NAME AS col, REFERENCED_TABLE_NAME AS ref, REFERENCED_COLUMN_NAME AS ref_col " +
+			"FROM information_schema.KEY_COLUMN_USAGE " +
+			"WHERE TABLE_SCHEMA = DATABASE() AND REFERENCED_TABLE_NAME IS NOT NULL " +
+			"ORDER BY TABLE_NAME, ORDINAL_POSITION"
+	}
+
+	rows, err := em.retrieveAllResultsByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	foreignKeys := make([]ForeignKey, 0, len(rows))
+	for _, row := range rows {
+		fk := ForeignKey{
+			Entity:           fmt.Sprintf("%v", row["entity"]),
+			Column:           fmt.Sprintf("%v", row["col"]),
+			References:       fmt.Sprintf("%v", row["ref"]),
+			ReferencedColumn: fmt.Sprintf("%v", row["ref_col"]),
+		}
+
+		if em.Dialect == SQLite {
+			// table names are case-insensitive, so they are lowercased like
+			// the entity names used in URLs and settings
+			fk.Entity, fk.References = strings.ToLower(fk.Entity), strings.ToLower(fk.References)
+
+			// the referenced column is left out when it is the primary key
+			if row["ref_col"] == nil {
+				fk.ReferencedColumn = em.GetIdColumn(fk.References)
+			}
+		}
+
+		foreignKeys = append(foreignKeys, fk)
+	}
+
+	return foreignKeys, nil
+}
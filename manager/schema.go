@@ -0,0 +1,223 @@
+package manager
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Column describes a column of an entity table, as reported by the database.
+type Column struct {
+	Name       string
+	Type       string
+	Nullable   bool
+	HasDefault bool
+	PrimaryKey bool
+	// Length is the maximum number of characters of a character column, or 0
+	// when the column is not bounded.
+	Length int
+}
+
+// columnKind is the family of values a column accepts.
+type columnKind int
+
+const (
+	otherKind columnKind = iota
+	integerKind
+	realKind
+	boolKind
+	textKind
+	datetimeKind
+)
+
+var columnLength = regexp.MustCompile(`(?i)char\s*\((\d+)\)`)
+
+// kind derives the family of a column from its declared type, following the
+// SQLite type affinity rules which also fit MySQL and Postgres names.
+func (c Column) kind() columnKind {
+	t := strings.ToUpper(c.Type)
+	switch {
+	case strings.Contains(t, "BOOL"):
+		return boolKind
+	case strings.Contains(t, "INT"):
+		return integerKind
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return textKind
+	case strings.Contains(t, "DATE"), strings.Contains(t, "TIME"):
+		return datetimeKind
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"),
+		strings.Contains(t, "DEC"), strings.Contains(t, "NUMERIC"):
+		return realKind
+	}
+	return otherKind
+}
+
+// schemaCache holds the columns of every entity read so far, whether they are
+// views, the parameters of the procedures called so far, and the foreign keys
+// of the database once read. It is shared by a
+// manager and the copies bound to its transactions.
+type schemaCache struct {
+	sync.RWMutex
+	columns         map[string][]Column
+	views           map[string]bool
+	procedureParams map[string][]string
+	foreignKeys     []ForeignKey
+	foreignKeysRead bool
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{columns: map[string][]Column{}, views: map[string]bool{}, procedureParams: map[string][]string{}}
+}
+
+// Columns returns the columns of entity. They are read from the database the
+// first time and cached afterwards.
+func (em *EntityDbManager) Columns(entity string) ([]Column, error) {
+	em.schema.RLock()
+	columns, ok := em.schema.columns[entity]
+	em.schema.RUnlock()
+
+	if ok {
+		return columns, nil
+	}
+
+	columns, err := em.readColumns(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	em.schema.Lock()
+	em.schema.columns[entity] = columns
+	em.schema.Unlock()
+
+	return columns, nil
+}
+
+// IsView reports whether entity is a view rather than a table. It is read
+// from the database the first time and cached afterwards, provided entity is
+// an existing table or view, so unknown names do not grow the cache.
+func (em *EntityDbManager) IsView(entity string) (bool, error) {
+	em.schema.RLock()
+	view, ok := em.schema.views[entity]
+	em.schema.RUnlock()
+
+	if ok {
+		return view, nil
+	}
+
+	var query string
+	switch em.Dialect {
+	case SQLite:
+		query = fmt.Sprintf("SELECT COUNT(*), COUNT(CASE WHEN type = 'view' THEN 1 END) FROM sqlite_master WHERE type IN ('table', 'view') AND name = %s COLLATE NOCASE", em.Dialect.quoteString(entity))
+	case Postgres:
+		query = fmt.Sprintf("SELECT COUNT(*), COUNT(CASE WHEN table_type = 'VIEW' THEN 1 END) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = %s", em.Dialect.quoteString(entity))
+	default:
+		query = fmt.Sprintf("SELECT COUNT(*), COUNT(CASE WHEN TABLE_TYPE = 'VIEW' THEN 1 END) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = %s", em.Dialect.quoteString(entity))
+	}
+
+	var count, views int
+	if err := em.conn().QueryRow(query).Scan(&count, &views); err != nil {
+		return false, err
+	}
+
+	if count > 0 {
+		em.schema.Lock()
+		em.schema.views[entity] = views > 0
+		em.schema.Unlock()
+	}
+
+	return views > 0, nil
+}
+
+// ClearSchemaCache forgets every cached column, view, procedure parameter and
+// foreign key, e.g. after a migration.
+func (em *EntityDbManager) ClearSchemaCache() {
+	em.schema.Lock()
+	em.schema.columns = map[string][]Column{}
+	em.schema.views = map[string]bool{}
+	em.schema.procedureParams = map[string][]string{}
+	em.schema.foreignKeys, em.schema.foreignKeysRead = nil, false
+	em.schema.Unlock()
+}
+
+func (em *EntityDbManager) readColumns(entity string) ([]Column, error) {
+	var columns []Column
+
+	switch em.Dialect {
+	case SQLite:
+		rows, err := em.retrieveAllResultsByQuery(fmt.Sprintf("PRAGMA table_info(`%s`)", entity))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			column := Column{
+				Name:       fmt.Sprintf("%v", row["name"]),
+				Type:       fmt.Sprintf("%v", row["type"]),
+				Nullable:   fmt.Sprintf("%v", row["notnull"]) == "0",
+				HasDefault: row["dflt_value"] != nil,
+				PrimaryKey: fmt.Sprintf("%v", row["pk"]) != "0",
+			}
+
+			// an INTEGER PRIMARY KEY is an alias of the generated rowid
+			if column.PrimaryKey && strings.EqualFold(column.Type, "INTEGER") {
+				column.HasDefault = true
+			}
+
+			columns = append(columns, column)
+		}
+	case Postgres:
+		rows, err := em.retrieveAllResultsByQuery(fmt.Sprintf(
+			"SELECT column_name, data_type, is_nullable, column_default, is_identity, character_maximum_length "+
+				"FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = '%s' "+
+				"ORDER BY ordinal_position",
+			entity,
+		))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			column := Column{
+				Name:       fmt.Sprintf("%v", row["column_name"]),
+				Type:       fmt.Sprintf("%v", row["data_type"]),
+				Nullable:   row["is_nullable"] == "YES",
+				HasDefault: row["column_default"] != nil || row["is_identity"] == "YES",
+			}
+
+			if length, err := strconv.Atoi(fmt.Sprintf("%v", row["character_maximum_length"])); err == nil {
+				column.Length = length
+			}
+
+			columns = append(columns, column)
+		}
+	default:
+		rows, err := em.retrieveAllResultsByQuery(fmt.Sprintf("SHOW COLUMNS FROM `%s`", entity))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			columns = append(columns, Column{
+				Name:       fmt.Sprintf("%v", row["Field"]),
+				Type:       fmt.Sprintf("%v", row["Type"]),
+				Nullable:   row["Null"] == "YES",
+				HasDefault: row["Default"] != nil || strings.Contains(fmt.Sprintf("%v", row["Extra"]), "auto_increment"),
+				PrimaryKey: row["Key"] == "PRI",
+			})
+		}
+	}
+
+	if len(columns) == 0 {
+		return nil, &DbError{Kind: UnknownEntity, Err: fmt.Errorf("no such table: %s", entity)}
+	}
+
+	for i, column := range columns {
+		if match := columnLength.FindStringSubmatch(column.Type); match != nil && column.Length == 0 {
+			columns[i].Length, _ = strconv.Atoi(match[1])
+		}
+	}
+
+	return columns, nil
+}
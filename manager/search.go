@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScoreField is the sort field ordering the results of a search by relevance.
+const ScoreField = "_score"
+
+// SearchIndex configures the full-text search of an entity over Columns.
+type SearchIndex struct {
+	Columns []string
+	// Index is the full-text index backing the search: the FTS5 table indexing
+	// Columns on SQLite, with the id of the entity as rowid, and the tsvector
+	// column on Postgres. On MySQL, any value states that a FULLTEXT index
+	// covers Columns. Without an index, Columns are searched with LIKE.
+	Index string
+}
+
+// SetSearchIndex enables the Search read option on entity.
+func (em *EntityDbManager) SetSearchIndex(entity string, index SearchIndex) {
+	em.searchIndexes[entity] = index
+}
+
+// searchCondition returns the WHERE condition matching the rows of entity
+// against query, and the SQL expression of their relevance.
+func (em *EntityDbManager) searchCondition(entity string, query string) (string, string, error) {
+	index, ok := em.searchIndexes[entity]
+	if !ok || len(index.Columns) == 0 {
+		return "", "", &QueryError{"_q", fmt.Sprintf("is not supported by %s", entity)}
+	}
+
+	if index.Index == "" {
+		return em.likeSearchCondition(entity, index, query)
+	}
+
+	switch em.Dialect {
+	case SQLite:
+		// every word is quoted, so the query cannot use the FTS5 syntax
+		words := strings.Fields(query)
+		for i, word := range words {
+			words[i] = fmt.Sprintf(`"%s"`, strings.Replace(word, `"`, `""`, -1))
+		}
+
+		match := fmt.Sprintf("`%s` MATCH %s", index.Index, em.Dialect.quoteString(strings.Join(words, " ")))
+		return fmt.Sprintf(
+				"`%s`.`%s` IN (SELECT rowid FROM `%s` WHERE %s)",
+				entity,
+				em.GetIdColumn(entity),
+				index.Index,
+				match,
+			), fmt.Sprintf(
+				"(SELECT -bm25(`%s`) FROM `%s` WHERE %s AND rowid = `%s`.`%s`)",
+				index.Index,
+				index.Index,
+				match,
+				entity,
+				em.GetIdColumn(entity),
+			), nil
+	case Postgres:
+		tsvector := fmt.Sprintf("%s.%s", em.Dialect.quoteIdentifier(entity), em.Dialect.quoteIdentifier(index.Index))
+		tsquery := fmt.Sprintf("plainto_tsquery(%s)", em.Dialect.quoteString(query))
+		return fmt.Sprintf("%s @@ %s", tsvector, tsquery),
+			fmt.Sprintf("ts_rank(%s, %s)", tsvector, tsquery), nil
+	}
+
+	columns := make([]string, len(index.Columns))
+	for i, column := range index.Columns {
+		columns[i] = fmt.Sprintf("`%s`.`%s`", entity, column)
+	}
+
+	match := fmt.Sprintf("MATCH (%s) AGAINST (%s IN NATURAL LANGUAGE MODE)", strings.Join(columns, ", "), em.Dialect.quoteString(query))
+	return match, match, nil
+}
+
+// likeSearchCondition searches the columns of index for query with LIKE, where
+// % and _ match themselves. The relevance of a row is the number of its
+// columns containing query.
+func (em *EntityDbManager) likeSearchCondition(entity string, index SearchIndex, query string) (string, string, error) {
+	pattern := em.Dialect.quoteString("%" + likeEscaper.Replace(query) + "%")
+
+	var conditions, scores []string
+	for _, column := range index.Columns {
+		expr, err := em.fieldExpression(entity, column)
+		if err != nil {
+			return "", "", err
+		}
+
+		condition := fmt.Sprintf("%s LIKE %s ESCAPE '!'", expr, pattern)
+		conditions = append(conditions, condition)
+		scores = append(scores, fmt.Sprintf("CASE WHEN %s THEN 1 ELSE 0 END", condition))
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(conditions, " OR ")),
+		fmt.Sprintf("(%s)", strings.Join(scores, " + ")), nil
+}
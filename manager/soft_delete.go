@@ -0,0 +1,108 @@
+package manager
+
+import (
+	"fmt"
+)
+
+// SoftDeleteMode is the kind of column marking a row as deleted.
+type SoftDeleteMode int
+
+const (
+	// SoftDeleteTimestamp marks deleted rows with the time of deletion, and
+	// live rows with NULL.
+	SoftDeleteTimestamp SoftDeleteMode = iota
+	// SoftDeleteBoolean marks deleted rows with 1, and live rows with 0 or NULL.
+	SoftDeleteBoolean
+)
+
+// DeletedScope selects which rows of a soft deleted entity are read.
+type DeletedScope int
+
+const (
+	ExcludeDeleted DeletedScope = iota
+	WithDeleted
+	OnlyDeleted
+)
+
+// ErrSoftDeleteNotConfigured is returned when restoring an entity that has no
+// soft delete column.
+var ErrSoftDeleteNotConfigured = newManagerError("soft delete is not configured for this entity")
+
+type softDelete struct {
+	column string
+	mode   SoftDeleteMode
+}
+
+func (sd softDelete) deletedValue() string {
+	if sd.mode == SoftDeleteBoolean {
+		return "1"
+	}
+	return "CURRENT_TIMESTAMP"
+}
+
+func (sd softDelete) liveValue() string {
+	if sd.mode == SoftDeleteBoolean {
+		return "0"
+	}
+	return "NULL"
+}
+
+// SetSoftDelete makes DeleteEntity mark the rows of entity as deleted in column
+// instead of removing them. Marked rows are then hidden from reads.
+func (em *EntityDbManager) SetSoftDelete(entity string, column string, mode SoftDeleteMode) {
+	em.softDeletes[entity] = softDelete{column, mode}
+}
+
+// RestoreEntity clears the soft delete marker of a deleted entity.
+func (em *EntityDbManager) RestoreEntity(entity string, id string) (int64, error) {
+	sd, ok := em.softDeletes[entity]
+	if !ok {
+		return 0, ErrSoftDeleteNotConfigured
+	}
+
+	query := fmt.Sprintf(
+		"UPDATE `%s` SET `%s` = %s WHERE %s = %s AND %s",
+		entity,
+		sd.column,
+		sd.liveValue(),
+		em.GetIdColumn(entity),
+		id,
+		em.softDeleteCondition(entity, OnlyDeleted),
+	)
+
+	res, err := em.conn().Exec(query)
+	if err != nil {
+		return 0, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return rowsAffected, nil
+}
+
+// softDeleteCondition returns the WHERE condition restricting reads of entity
+// to scope, or an empty string when no restriction applies. The column is
+// qualified with the table, which may be joined to others having it too.
+func (em *EntityDbManager) softDeleteCondition(entity string, scope DeletedScope) string {
+	sd, ok := em.softDeletes[entity]
+	if !ok || scope == WithDeleted {
+		return ""
+	}
+
+	column := fmt.Sprintf("`%s`.`%s`", entity, sd.column)
+
+	if sd.mode == SoftDeleteBoolean {
+		if scope == OnlyDeleted {
+			return fmt.Sprintf("%s = 1", column)
+		}
+		return fmt.Sprintf("(%s IS NULL OR %s = 0)", column, column)
+	}
+
+	if scope == OnlyDeleted {
+		return fmt.Sprintf("%s IS NOT NULL", column)
+	}
+	return fmt.Sprintf("%s IS NULL", column)
+}
@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"strconv"
+	"time"
+)
+
+// TimestampFormat is the representation of a managed timestamp column.
+type TimestampFormat int
+
+const (
+	// TimestampDatetime stores "2006-01-02 15:04:05" UTC strings.
+	TimestampDatetime TimestampFormat = iota
+	// TimestampEpoch stores Unix seconds as integers.
+	TimestampEpoch
+)
+
+const DatetimeLayout = "2006-01-02 15:04:05"
+
+// TimestampColumns declares the columns the manager fills when an entity is
+// created or updated. Either column may be left empty.
+type TimestampColumns struct {
+	Created string
+	Updated string
+	Format  TimestampFormat
+}
+
+// timestampLayouts are the string formats accepted for timestamp columns,
+// including the one produced by convertDbValue for time.Time values.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339Nano,
+	DatetimeLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// SetLastModifiedColumn declares the column of entity holding the time of its
+// last modification, either as a datetime or as epoch seconds.
+func (em *EntityDbManager) SetLastModifiedColumn(entity string, column string) {
+	em.lastModified[entity] = column
+}
+
+// GetLastModifiedColumn returns the last modification column of entity, if
+// any. It defaults to the managed update timestamp column.
+func (em *EntityDbManager) GetLastModifiedColumn(entity string) (string, bool) {
+	if v, ok := em.lastModified[entity]; ok {
+		return v, ok
+	}
+
+	if ts, ok := em.timestamps[entity]; ok && ts.Updated != "" {
+		return ts.Updated, true
+	}
+
+	return "", false
+}
+
+// SetTimestampColumns makes the manager fill the creation and update time
+// columns of entity. Values sent by clients for those columns are ignored.
+func (em *EntityDbManager) SetTimestampColumns(entity string, columns TimestampColumns) {
+	em.timestamps[entity] = columns
+}
+
+// isManagedTimestamp reports whether column of entity is filled by the manager.
+func (em *EntityDbManager) isManagedTimestamp(entity string, column string) bool {
+	ts, ok := em.timestamps[entity]
+	return ok && column != "" && (column == ts.Created || column == ts.Updated)
+}
+
+// timestampValue returns the current time in the format of entity's managed
+// timestamp columns.
+func (em *EntityDbManager) timestampValue(entity string) interface{} {
+	now := time.Now().UTC()
+	if em.timestamps[entity].Format == TimestampEpoch {
+		return now.Unix()
+	}
+	return now.Format(DatetimeLayout)
+}
+
+// stampCreate returns a copy of data where the managed timestamp columns of
+// entity are set to the current time instead of the values sent by the client.
+func (em *EntityDbManager) stampCreate(entity string, data map[string]interface{}) map[string]interface{} {
+	ts, ok := em.timestamps[entity]
+	if !ok {
+		return data
+	}
+
+	stamped := copyData(data)
+
+	for _, column := range []string{ts.Created, ts.Updated} {
+		if column != "" {
+			stamped[column] = em.timestampValue(entity)
+		}
+	}
+
+	return stamped
+}
+
+// LastModified returns the most recent modification time found in rows. The
+// boolean is false when entity has no last modification column or none of the
+// rows holds a valid time.
+func (em *EntityDbManager) LastModified(entity string, rows ...map[string]interface{}) (time.Time, bool) {
+	var lastModified time.Time
+
+	column, ok := em.GetLastModifiedColumn(entity)
+	if !ok {
+		return lastModified, false
+	}
+
+	found := false
+	for _, row := range rows {
+		if t, ok := parseTimestamp(row[column]); ok {
+			if !found || t.After(lastModified) {
+				lastModified = t
+			}
+			found = true
+		}
+	}
+
+	return lastModified, found
+}
+
+func parseTimestamp(value interface{}) (time.Time, bool) {
+	switch t := value.(type) {
+	case int64:
+		return time.Unix(t, 0).UTC(), true
+	case int:
+		return time.Unix(int64(t), 0).UTC(), true
+	case float64:
+		return time.Unix(int64(t), 0).UTC(), true
+	case time.Time:
+		return t.UTC(), true
+	case string:
+		if epoch, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return time.Unix(epoch, 0).UTC(), true
+		}
+
+		for _, layout := range timestampLayouts {
+			if parsed, err := time.Parse(layout, t); err == nil {
+				return parsed.UTC(), true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,260 @@
+package manager
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FieldTransformer converts the value of a field between the representation
+// sent and returned by clients and the one stored in the database.
+type FieldTransformer interface {
+	// Write returns the value stored for a value sent by a client.
+	Write(value interface{}) (interface{}, error)
+	// Read returns the value returned for a stored value, and false when the
+	// field must not be returned at all.
+	Read(value interface{}) (interface{}, bool, error)
+}
+
+// Verifier is implemented by transformers whose stored values can be checked
+// against a value sent by a client, such as password hashes.
+type Verifier interface {
+	Verify(stored interface{}, candidate interface{}) (bool, error)
+}
+
+// SetFieldTransformer transforms the values of field of entity on write and
+// read. Transformed fields cannot be used to filter or sort.
+func (em *EntityDbManager) SetFieldTransformer(entity string, field string, transformer FieldTransformer) {
+	if em.transformers[entity] == nil {
+		em.transformers[entity] = map[string]FieldTransformer{}
+	}
+	em.transformers[entity][field] = transformer
+}
+
+// transformWrite replaces the values of data by the ones to store, and fills
+// the blind indexes of the encrypted fields it contains.
+func (em *EntityDbManager) transformWrite(entity string, data map[string]interface{}) error {
+	for field, bi := range em.blindIndexes[entity] {
+		// blind indexes are only ever written from the plaintext
+		delete(data, bi.column)
+
+		if value, ok := data[field]; ok && value != nil {
+			data[bi.column] = bi.hash(value)
+		} else if ok {
+			data[bi.column] = nil
+		}
+	}
+
+	for field, transformer := range em.transformers[entity] {
+		value, ok := data[field]
+		if !ok || value == nil {
+			continue
+		}
+
+		stored, err := transformer.Write(value)
+		if err != nil {
+			return err
+		}
+		data[field] = stored
+	}
+	return nil
+}
+
+// transformRead replaces the stored values of row by the ones to return, and
+// drops the fields that must not be returned.
+func (em *EntityDbManager) transformRead(entity string, row map[string]interface{}) error {
+	for _, bi := range em.blindIndexes[entity] {
+		delete(row, bi.column)
+	}
+
+	for field, transformer := range em.transformers[entity] {
+		value, ok := row[field]
+		if !ok {
+			continue
+		}
+
+		returned, keep, err := transformer.Read(value)
+		if err != nil {
+			return err
+		} else if !keep {
+			delete(row, field)
+			continue
+		}
+		row[field] = returned
+	}
+	return nil
+}
+
+// readEntityTag returns the entity tag of a stored row, computed on the row
+// as GET returns it, after its transformations, virtual fields and AfterRead
+// hooks, so it matches the tag clients were sent.
+func (em *EntityDbManager) readEntityTag(entity string, row map[string]interface{}) (string, error) {
+	returned := copyData(row)
+	if err := em.finishRow(entity, returned, &readOptions{}); err != nil {
+		return "", err
+	}
+	return em.EntityTag(entity, returned), nil
+}
+
+// VerifyEntity checks the values of candidates against the stored fields of
+// the entity. verified is true when every value matches; found is false when
+// the entity does not exist.
+func (em *EntityDbManager) VerifyEntity(entity string, id string, candidates map[string]interface{}) (verified bool, found bool, err error) {
+	if len(candidates) == 0 {
+		return false, false, &QueryError{"body", "must contain at least one field to verify"}
+	}
+
+	verifiers := map[string]Verifier{}
+	for field := range candidates {
+		verifier, ok := em.transformers[entity][field].(Verifier)
+		if !ok {
+			return false, false, &QueryError{field, "cannot be verified"}
+		}
+		verifiers[field] = verifier
+	}
+
+	row, err := em.retrieveSingleResultById(entity, id, ExcludeDeleted)
+	if err != nil || len(row) <= 0 {
+		return false, false, err
+	}
+
+	verified = true
+	for field, verifier := range verifiers {
+		ok, err := verifier.Verify(row[field], candidates[field])
+		if err != nil {
+			return false, true, err
+		}
+		// every field is checked, so the time taken does not tell which one failed
+		verified = verified && ok
+	}
+
+	return verified, true, nil
+}
+
+// bcryptMaxLength is the length in bytes of the longest value bcrypt hashes.
+const bcryptMaxLength = 72
+
+// bcryptHasher stores bcrypt hashes of values.
+type bcryptHasher struct {
+	cost int
+}
+
+// Bcrypt returns a transformer storing bcrypt hashes of values, which are
+// never returned but can be verified. A zero cost uses bcrypt.DefaultCost.
+func Bcrypt(cost int) FieldTransformer {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return &bcryptHasher{cost}
+}
+
+func (h *bcryptHasher) Write(value interface{}) (interface{}, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(fmt.Sprintf("%v", value)), h.cost)
+	if err != nil {
+		return nil, err
+	}
+	return string(hash), nil
+}
+
+func (h *bcryptHasher) Read(value interface{}) (interface{}, bool, error) {
+	return nil, false, nil
+}
+
+func (h *bcryptHasher) Verify(stored interface{}, candidate interface{}) (bool, error) {
+	if stored == nil {
+		return false, nil
+	}
+
+	// values that are not bcrypt hashes, e.g. stored before the transformer
+	// was set, never match
+	err := bcrypt.CompareHashAndPassword([]byte(fmt.Sprintf("%v", stored)), []byte(fmt.Sprintf("%v", candidate)))
+	return err == nil, nil
+}
+
+// Argon2Params are the parameters of argon2id hashes, see
+// https://tools.ietf.org/html/rfc9106 for their recommended values.
+type Argon2Params struct {
+	Time       uint32
+	Memory     uint32 // in KiB
+	Threads    uint8
+	KeyLength  uint32
+	SaltLength uint32
+}
+
+// DefaultArgon2Params follow the second recommended option of RFC 9106.
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4, KeyLength: 32, SaltLength: 16}
+
+// argon2Hasher stores argon2id hashes of values.
+type argon2Hasher struct {
+	params Argon2Params
+}
+
+// Argon2id returns a transformer storing argon2id hashes of values, encoded in
+// the PHC string format, which are never returned but can be verified.
+func Argon2id(params Argon2Params) FieldTransformer {
+	return &argon2Hasher{params}
+}
+
+func (h *argon2Hasher) Write(value interface{}) (interface{}, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(fmt.Sprintf("%v", value)), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory,
+		h.params.Time,
+		h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *argon2Hasher) Read(value interface{}) (interface{}, bool, error) {
+	return nil, false, nil
+}
+
+// Verify reads the parameters from the stored hash, so values hashed before a
+// change of parameters can still be verified. Values that are not argon2id
+// hashes never match.
+func (h *argon2Hasher) Verify(stored interface{}, candidate interface{}) (bool, error) {
+	if stored == nil {
+		return false, nil
+	}
+
+	parts := strings.Split(fmt.Sprintf("%v", stored), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, nil
+	}
+
+	var version int
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, nil
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return false, nil
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, nil
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, nil
+	}
+
+	candidateKey := argon2.IDKey([]byte(fmt.Sprintf("%v", candidate)), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, candidateKey) == 1, nil
+}
@@ -0,0 +1,254 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rule checks the value of a field, returning an error describing why it is
+// invalid. Rules are not run on null values.
+type Rule func(value interface{}) error
+
+// FieldError describes why the value of a field is invalid.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError lists every invalid field of a payload.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = fmt.Sprintf("%s %s", field.Field, field.Message)
+	}
+	return fmt.Sprintf("invalid entity: %s", strings.Join(messages, ", "))
+}
+
+// AddRule adds validation rules to a field of entity, checked whenever the
+// field is written.
+func (em *EntityDbManager) AddRule(entity string, field string, rules ...Rule) {
+	if em.rules[entity] == nil {
+		em.rules[entity] = map[string][]Rule{}
+	}
+	em.rules[entity][field] = append(em.rules[entity][field], rules...)
+}
+
+// Validate checks data against the schema of entity and its rules. On create,
+// unknown fields and missing NOT NULL columns without default are rejected as
+// well. The returned error is a *ValidationError listing every invalid field.
+func (em *EntityDbManager) Validate(entity string, data map[string]interface{}, create bool) error {
+	var fieldErrors []FieldError
+	invalid := func(field string, format string, args ...interface{}) {
+		fieldErrors = append(fieldErrors, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	// without a schema, for instance on an unknown entity, only rules are run
+	if columns, err := em.Columns(entity); err == nil {
+		known := make(map[string]bool, len(columns))
+
+		for _, column := range columns {
+			known[column.Name] = true
+			value, present := data[column.Name]
+
+			if !present {
+				if create && !column.Nullable && !column.HasDefault && !em.isManagedTimestamp(entity, column.Name) {
+					invalid(column.Name, "is required")
+				}
+				continue
+			}
+
+			if value == nil {
+				if !column.Nullable {
+					invalid(column.Name, "is required")
+				}
+				continue
+			}
+
+			// encrypted values are stored longer than they are written
+			if e, ok := em.transformers[entity][column.Name].(*encryptor); ok && column.Length > 0 {
+				maxLength, err := e.maxLength(column.Length)
+				if err != nil {
+					return err
+				} else if len(fmt.Sprintf("%v", value)) > maxLength {
+					invalid(column.Name, "must be at most %d bytes long once encrypted", maxLength)
+				}
+				column.Length = 0
+			}
+
+			// bcrypt rejects longer values rather than hashing them
+			if _, ok := em.transformers[entity][column.Name].(*bcryptHasher); ok && len(fmt.Sprintf("%v", value)) > bcryptMaxLength {
+				invalid(column.Name, "must be at most %d bytes long", bcryptMaxLength)
+			}
+
+			if message := checkColumnValue(column, value); message != "" {
+				invalid(column.Name, "%s", message)
+			}
+		}
+
+		if create {
+			for field := range data {
+				if !known[field] {
+					invalid(field, "is not a field of %s", entity)
+				}
+			}
+		}
+	}
+
+	for field, rules := range em.rules[entity] {
+		value, present := data[field]
+		if !present || value == nil {
+			continue
+		}
+
+		for _, rule := range rules {
+			if err := rule(value); err != nil {
+				invalid(field, "%s", err.Error())
+			}
+		}
+	}
+
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(fieldErrors, func(i, j int) bool {
+		return fieldErrors[i].Field < fieldErrors[j].Field
+	})
+
+	return &ValidationError{fieldErrors}
+}
+
+// checkColumnValue returns why a JSON value does not fit column, or an empty
+// string when it does.
+func checkColumnValue(column Column, value interface{}) string {
+	switch t := value.(type) {
+	case map[string]interface{}, []interface{}:
+		return "must be a scalar value"
+	case string:
+		switch column.kind() {
+		case integerKind, boolKind:
+			if _, err := strconv.ParseInt(t, 10, 64); err != nil {
+				return "must be an integer"
+			}
+		case realKind:
+			if _, err := strconv.ParseFloat(t, 64); err != nil {
+				return "must be a number"
+			}
+		case datetimeKind:
+			if _, ok := parseTimestamp(t); !ok {
+				return "must be a date and time"
+			}
+		}
+
+		if column.Length > 0 && utf8.RuneCountInString(t) > column.Length {
+			return fmt.Sprintf("must be at most %d characters long", column.Length)
+		}
+	case float64:
+		switch column.kind() {
+		case integerKind, boolKind:
+			if t != math.Trunc(t) {
+				return "must be an integer"
+			}
+		case textKind:
+			return "must be a string"
+		}
+	case bool:
+		switch column.kind() {
+		case realKind, textKind, datetimeKind:
+			return "must be a boolean"
+		}
+	}
+
+	return ""
+}
+
+// Regex requires string values to match pattern.
+func Regex(pattern string) Rule {
+	re := regexp.MustCompile(pattern)
+	return func(value interface{}) error {
+		if !re.MatchString(fmt.Sprintf("%v", value)) {
+			return fmt.Errorf("must match %s", pattern)
+		}
+		return nil
+	}
+}
+
+// Min requires numeric values to be greater than or equal to min.
+func Min(min float64) Rule {
+	return func(value interface{}) error {
+		if n, ok := toFloat(value); !ok || n < min {
+			return fmt.Errorf("must be at least %v", min)
+		}
+		return nil
+	}
+}
+
+// Max requires numeric values to be lower than or equal to max.
+func Max(max float64) Rule {
+	return func(value interface{}) error {
+		if n, ok := toFloat(value); !ok || n > max {
+			return fmt.Errorf("must be at most %v", max)
+		}
+		return nil
+	}
+}
+
+// Enum requires values to be one of values.
+func Enum(values ...interface{}) Rule {
+	return func(value interface{}) error {
+		for _, v := range values {
+			if fmt.Sprintf("%v", v) == fmt.Sprintf("%v", value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v", values)
+	}
+}
+
+// Email requires values to be e-mail addresses.
+func Email() Rule {
+	return func(value interface{}) error {
+		s, ok := value.(string)
+		if addr, err := mail.ParseAddress(s); !ok || err != nil || addr.Address != s {
+			return fmt.Errorf("must be an e-mail address")
+		}
+		return nil
+	}
+}
+
+// URL requires values to be absolute http or https URLs.
+func URL() Rule {
+	return func(value interface{}) error {
+		s, _ := value.(string)
+		if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("must be a URL")
+		}
+		return nil
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch t := value.(type) {
+	case float64:
+		return t, true
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case string:
+		n, err := strconv.ParseFloat(t, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
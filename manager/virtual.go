@@ -0,0 +1,62 @@
+package manager
+
+import "fmt"
+
+// VirtualField is a field of an entity that is not a column of its table.
+// Virtual fields are only returned when requested through the Fields option.
+type VirtualField struct {
+	Name string
+	// Expr is an SQL expression computed by the database, which can also be
+	// used to filter and sort, e.g. a subquery counting related rows.
+	Expr string
+	// Func computes the field from the other fields of a row once it has
+	// been read. It is ignored when Expr is set.
+	Func func(row map[string]interface{}) interface{}
+}
+
+// AddVirtualField declares a virtual field of entity.
+func (em *EntityDbManager) AddVirtualField(entity string, field VirtualField) {
+	em.virtuals[entity] = append(em.virtuals[entity], field)
+}
+
+func (em *EntityDbManager) virtualField(entity string, name string) (VirtualField, bool) {
+	for _, vf := range em.virtuals[entity] {
+		if vf.Name == name {
+			return vf, true
+		}
+	}
+	return VirtualField{}, false
+}
+
+// selectClause returns the columns selected by a read: every column of the
+// table, followed by the SQL virtual fields requested in options.
+func (em *EntityDbManager) selectClause(entity string, options *readOptions) string {
+	clause := "*"
+
+	for _, vf := range em.virtuals[entity] {
+		if vf.Expr != "" && options.wantsField(vf.Name) {
+			if clause == "*" {
+				clause = fmt.Sprintf("`%s`.*", entity)
+			}
+			clause = fmt.Sprintf("%s, (%s) AS `%s`", clause, vf.Expr, vf.Name)
+		}
+	}
+
+	return clause
+}
+
+// finishRow completes a row read from entity: it transforms the stored values,
+// computes the requested Func virtual fields and runs the AfterRead hooks.
+func (em *EntityDbManager) finishRow(entity string, row map[string]interface{}, options *readOptions) error {
+	if err := em.transformRead(entity, row); err != nil {
+		return err
+	}
+
+	for _, vf := range em.virtuals[entity] {
+		if vf.Expr == "" && vf.Func != nil && options.wantsField(vf.Name) {
+			row[vf.Name] = vf.Func(row)
+		}
+	}
+
+	return em.afterRead(entity, row)
+}
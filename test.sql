@@ -1,14 +1,18 @@
+DROP VIEW IF EXISTS post_summary;
 DROP TABLE IF EXISTS Lookup;
 DROP TABLE IF EXISTS User;
 DROP TABLE IF EXISTS Post;
 DROP TABLE IF EXISTS Comment;
 DROP TABLE IF EXISTS Tag;
+DROP TABLE IF EXISTS post_tag;
 
 CREATE TABLE Lookup ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name VARCHAR(128) NOT NULL, code INTEGER NOT NULL, type VARCHAR(128) NOT NULL, position INTEGER NOT NULL );
 CREATE TABLE User ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, username VARCHAR(128) NOT NULL, password VARCHAR(128) NOT NULL, salt VARCHAR(128) NOT NULL, email VARCHAR(128) NOT NULL, profile TEXT );
 CREATE TABLE Post ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, title VARCHAR(128) NOT NULL, content TEXT NOT NULL, tags TEXT, status INTEGER NOT NULL, create_time INTEGER, update_time INTEGER, author_id INTEGER NOT NULL, CONSTRAINT FK_post_author FOREIGN KEY (author_id) REFERENCES User (id) ON DELETE CASCADE ON UPDATE RESTRICT );
-CREATE TABLE Comment ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, content TEXT NOT NULL, status INTEGER NOT NULL, create_time INTEGER, author VARCHAR(128) NOT NULL, email VARCHAR(128) NOT NULL, url VARCHAR(128), post_id INTEGER NOT NULL, CONSTRAINT FK_comment_post FOREIGN KEY (post_id) REFERENCES Post (id) ON DELETE CASCADE ON UPDATE RESTRICT );
+CREATE TABLE Comment ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, content TEXT NOT NULL, status INTEGER NOT NULL, create_time INTEGER, author VARCHAR(128) NOT NULL, email VARCHAR(128) NOT NULL, url VARCHAR(128), post_id INTEGER NOT NULL, deleted_at DATETIME, email_index VARCHAR(64), CONSTRAINT FK_comment_post FOREIGN KEY (post_id) REFERENCES Post (id) ON DELETE CASCADE ON UPDATE RESTRICT );
 CREATE TABLE Tag ( id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name VARCHAR(128) NOT NULL, frequency INTEGER DEFAULT 1 );
+CREATE TABLE post_tag ( post_id INTEGER NOT NULL, tag_id INTEGER NOT NULL, PRIMARY KEY (post_id, tag_id), CONSTRAINT FK_post_tag_post FOREIGN KEY (post_id) REFERENCES Post (id) ON DELETE CASCADE, CONSTRAINT FK_post_tag_tag FOREIGN KEY (tag_id) REFERENCES Tag (id) ON DELETE CASCADE );
+CREATE VIEW post_summary AS SELECT id, title, status FROM Post;
 
 INSERT INTO Lookup (name, type, code, position) VALUES ('Draft', 'PostStatus', 1, 1);
 INSERT INTO Lookup (name, type, code, position) VALUES ('Published', 'PostStatus', 2, 2);